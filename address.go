@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hashicorp/go-sockaddr/template"
+)
+
+// defaultRouteAddress is the --service-ip value selecting the source address
+// of the default route.
+const defaultRouteAddress = "default-route"
+
+// address families of --service-ip-family
+const (
+	addressFamilyIPv4 = "ipv4"
+	addressFamilyIPv6 = "ipv6"
+	addressFamilyDual = "dual"
+)
+
+// well known addresses to route to, connecting a UDP socket sends no packet
+var defaultRouteProbes = map[string]string{
+	addressFamilyIPv4: "198.51.100.1:53",
+	addressFamilyIPv6: "[2001:db8::1]:53",
+}
+
+// serviceAddresses are the addresses the exporter registers. ipv6 is only set
+// when both families were requested.
+type serviceAddresses struct {
+	address string
+	ipv4    string
+	ipv6    string
+}
+
+// resolveServiceAddresses picks the service address of family from spec, an IP
+// address, an interface name, a go-sockaddr template or "default-route".
+// Loopback addresses are refused unless allowLoopback is set, other hosts
+// could not reach the exporter there.
+func resolveServiceAddresses(spec, family string, allowLoopback bool) (serviceAddresses, error) {
+	var addresses serviceAddresses
+
+	candidates, err := serviceAddressCandidates(spec)
+	if err != nil {
+		return addresses, err
+	}
+
+	var ipv4, ipv6 net.IP
+	for _, ip := range candidates {
+		// link local addresses need a zone, they are useless to other hosts
+		if ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			continue
+		}
+		if ip.IsLoopback() && !allowLoopback {
+			continue
+		}
+		if ip.To4() != nil {
+			if ipv4 == nil {
+				ipv4 = ip
+			}
+		} else if ipv6 == nil {
+			ipv6 = ip
+		}
+	}
+
+	switch family {
+	case addressFamilyIPv4:
+		ipv6 = nil
+	case addressFamilyIPv6:
+		ipv4 = nil
+	case addressFamilyDual:
+	default:
+		return addresses, fmt.Errorf("unknown address family %q, use ipv4, ipv6 or dual", family)
+	}
+
+	if ipv4 == nil && ipv6 == nil {
+		if hasLoopback(candidates) && !allowLoopback {
+			return addresses, fmt.Errorf("service address %q resolves to loopback %v only, set --service-allow-loopback to register it", spec, candidates)
+		}
+		return addresses, fmt.Errorf("service address %q has no usable %s address in %v", spec, family, candidates)
+	}
+
+	// dual stack registers the IPv4 address and announces the IPv6 one as meta
+	if ipv4 != nil {
+		addresses.address = ipv4.String()
+		addresses.ipv4 = ipv4.String()
+	}
+	if ipv6 != nil {
+		if addresses.address == "" {
+			addresses.address = ipv6.String()
+		}
+		addresses.ipv6 = ipv6.String()
+	}
+	if family != addressFamilyDual {
+		addresses.ipv4, addresses.ipv6 = "", ""
+	}
+	return addresses, nil
+}
+
+// serviceAddressCandidates lists the addresses spec stands for.
+func serviceAddressCandidates(spec string) ([]net.IP, error) {
+	if spec == "" || spec == defaultRouteAddress {
+		return defaultRouteIPs()
+	}
+	if ip := net.ParseIP(spec); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if !strings.Contains(spec, "{{") {
+		inter, err := net.InterfaceByName(spec)
+		if err != nil {
+			return nil, fmt.Errorf("service address %q is no IP address, interface or template: %s", spec, err)
+		}
+		return interfaceIPs(inter)
+	}
+
+	result, err := template.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("parse service address template %q: %s", spec, err)
+	}
+	var ips []net.IP
+	for _, field := range strings.Fields(result) {
+		// templates may render CIDRs or host:port pairs
+		if host, _, err := net.SplitHostPort(field); err == nil {
+			field = host
+		}
+		if ip, _, err := net.ParseCIDR(field); err == nil {
+			ips = append(ips, ip)
+		} else if ip := net.ParseIP(field); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("service address template %q rendered no IP address: %q", spec, result)
+	}
+	return ips, nil
+}
+
+// defaultRouteIPs returns the source addresses the kernel picks for the IPv4
+// and IPv6 default routes.
+func defaultRouteIPs() ([]net.IP, error) {
+	var ips []net.IP
+	var errs []string
+	for _, family := range []string{addressFamilyIPv4, addressFamilyIPv6} {
+		conn, err := net.Dial("udp", defaultRouteProbes[family])
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		ips = append(ips, conn.LocalAddr().(*net.UDPAddr).IP)
+		conn.Close()
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no default route: %s", strings.Join(errs, ", "))
+	}
+	return ips, nil
+}
+
+func interfaceIPs(inter *net.Interface) ([]net.IP, error) {
+	interAddresses, err := inter.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("get network interface %s address error: %s", inter.Name, err)
+	}
+	var ips []net.IP
+	for _, interAddr := range interAddresses {
+		ip, _, err := net.ParseCIDR(interAddr.String())
+		if err != nil {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("network interface %s has no address", inter.Name)
+	}
+	return ips, nil
+}
+
+func hasLoopback(ips []net.IP) bool {
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			return true
+		}
+	}
+	return false
+}
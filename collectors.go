@@ -1,72 +1,420 @@
 package main
 
 import (
+	"os"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// dockerMetrics is the set of container metrics collected from docker daemons.
+// The exporter keeps one set on registry, every probe collects into a new one.
+type dockerMetrics struct {
+	memoryLimit      *prometheus.GaugeVec
+	memoryUsage      *prometheus.GaugeVec
+	memoryRss        *prometheus.GaugeVec
+	cpuUser          *prometheus.GaugeVec
+	cpuKernel        *prometheus.GaugeVec
+	cpuAll           *prometheus.GaugeVec
+	cpuSystem        *prometheus.GaugeVec
+	rxBytes          *prometheus.GaugeVec
+	rxPackets        *prometheus.GaugeVec
+	txBytes          *prometheus.GaugeVec
+	txPackets        *prometheus.GaugeVec
+	networkInfo      *prometheus.GaugeVec
+	tcpConnections   *prometheus.GaugeVec
+	tcpListen        *prometheus.GaugeVec
+	sockstat         *prometheus.GaugeVec
+	blkioBytes       *prometheus.GaugeVec
+	blkioOps         *prometheus.GaugeVec
+	pidsCurrent      *prometheus.GaugeVec
+	pidsLimit        *prometheus.GaugeVec
+	state            *prometheus.GaugeVec
+	restartCount     *prometheus.GaugeVec
+	startedAt        *prometheus.GaugeVec
+	healthStatus     *prometheus.GaugeVec
+	healthFailing    *prometheus.GaugeVec
+	daemonInfo       *prometheus.GaugeVec
+	daemonContainers *prometheus.GaugeVec
+	daemonImages     *prometheus.GaugeVec
+	diskUsage        *prometheus.GaugeVec
+	diskUsageObjects *prometheus.GaugeVec
+	imageSize        *prometheus.GaugeVec
+	imageCreated     *prometheus.GaugeVec
+	events           *prometheus.CounterVec
+	scrapeNumber     *prometheus.CounterVec
+	statsNumber      *prometheus.GaugeVec
+	dockerHostUp     *prometheus.GaugeVec
+	dockerHostErrors *prometheus.CounterVec
+
+	// exporter self observability
+	apiDuration       *prometheus.HistogramVec
+	collectorDuration *prometheus.GaugeVec
+	collectorSuccess  *prometheus.GaugeVec
+	statsErrors       *prometheus.CounterVec
+	lastSuccess       *prometheus.GaugeVec
+}
+
+func newDockerMetrics() *dockerMetrics {
+	return &dockerMetrics{
+		memoryLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_memory_stats_limit",
+			Help: "Memory Limit.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		memoryUsage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_memory_stats_usage",
+			Help: "Total memory usage, include Virtual Memory Size.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		memoryRss: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_memory_stats_rss",
+			Help: "Resident Memory Size.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		cpuUser: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_cpu_stats_usermode",
+			Help: "time running un-niced user processes.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		cpuKernel: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_cpu_stats_kernelmode",
+			Help: "time running kernel processes.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		cpuAll: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_cpu_stats_all",
+			Help: "total cpu time for container.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		cpuSystem: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_cpu_stats_system",
+			Help: "host total cpu time.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		rxBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_networks_rx_bytes",
+			Help: "network received bytes.",
+		},
+			[]string{"docker_host", "container_name", "container_id", "interface"}),
+		rxPackets: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_networks_rx_packets",
+			Help: "network received packets.",
+		},
+			[]string{"docker_host", "container_name", "container_id", "interface"}),
+		txBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_networks_tx_bytes",
+			Help: "network send bytes.",
+		},
+			[]string{"docker_host", "container_name", "container_id", "interface"}),
+		txPackets: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_networks_tx_packets",
+			Help: "network send packets.",
+		},
+			[]string{"docker_host", "container_name", "container_id", "interface"}),
+		networkInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_networks_info",
+			Help: "container network interface with host veth peer, docker network and ip address, always 1.",
+		},
+			[]string{"docker_host", "container_name", "container_id", "interface", "host_interface", "network", "ip_address"}),
+		tcpConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_tcp_connections",
+			Help: "tcp connections by state, listening sockets excluded.",
+		},
+			[]string{"docker_host", "container_name", "container_id", "state"}),
+		tcpListen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_tcp_listen",
+			Help: "tcp listening sockets.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		sockstat: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_sockstat",
+			Help: "socket statistics from the container network namespace (/proc/net/sockstat).",
+		},
+			[]string{"docker_host", "container_name", "container_id", "protocol", "field"}),
+		blkioBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_blkio_service_bytes",
+			Help: "bytes transferred to and from the block device by operation.",
+		},
+			[]string{"docker_host", "container_name", "container_id", "device", "op"}),
+		blkioOps: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_blkio_serviced",
+			Help: "io requests to the block device by operation.",
+		},
+			[]string{"docker_host", "container_name", "container_id", "device", "op"}),
+		pidsCurrent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_pids_current",
+			Help: "processes and threads in the container.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		pidsLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_pids_limit",
+			Help: "process limit of the container, only set with a limit.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		state: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_state",
+			Help: "1 for the current state of the container (created, running, paused, restarting, removing, exited, dead).",
+		},
+			[]string{"docker_host", "container_name", "container_id", "state"}),
+		restartCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_restart_count",
+			Help: "restarts of the container by its restart policy.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		startedAt: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_started_timestamp_seconds",
+			Help: "start time of the container.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		healthStatus: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_health_status",
+			Help: "1 for the current HEALTHCHECK status of the container (starting, healthy, unhealthy).",
+		},
+			[]string{"docker_host", "container_name", "container_id", "status"}),
+		healthFailing: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_health_failing_streak",
+			Help: "consecutive failed HEALTHCHECK runs of the container.",
+		},
+			[]string{"docker_host", "container_name", "container_id"}),
+		daemonInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_daemon_info",
+			Help: "docker daemon version, os and storage driver, always 1.",
+		},
+			[]string{"docker_host", "server_version", "operating_system", "kernel_version", "storage_driver"}),
+		daemonContainers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_daemon_containers",
+			Help: "containers of the docker daemon by state (running, paused, stopped).",
+		},
+			[]string{"docker_host", "state"}),
+		daemonImages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_daemon_images",
+			Help: "images of the docker daemon.",
+		},
+			[]string{"docker_host"}),
+		diskUsage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_disk_usage_bytes",
+			Help: "disk space used by type (images, containers, volumes, build_cache).",
+		},
+			[]string{"docker_host", "type"}),
+		diskUsageObjects: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_disk_usage_objects",
+			Help: "objects using disk space by type (images, containers, volumes, build_cache).",
+		},
+			[]string{"docker_host", "type"}),
+		imageSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_image_size_bytes",
+			Help: "size of the image including its parent layers.",
+		},
+			[]string{"docker_host", "image_id", "repo_tag"}),
+		imageCreated: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_image_created_timestamp_seconds",
+			Help: "creation time of the image.",
+		},
+			[]string{"docker_host", "image_id", "repo_tag"}),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "docker_events_total",
+			Help: "docker events by type and action.",
+		},
+			[]string{"docker_host", "type", "action"}),
+		scrapeNumber: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "docker_container_scrape_total",
+			Help: "the number of scrape."},
+			[]string{"docker_host"}),
+		statsNumber: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_stats_num",
+			Help: "The amount of docker container stats"},
+			[]string{"docker_host"}),
+		dockerHostUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_host_up",
+			Help: "whether the last container list of the docker daemon succeeded."},
+			[]string{"docker_host"}),
+		dockerHostErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "docker_host_errors_total",
+			Help: "the number of failed docker api requests."},
+			[]string{"docker_host"}),
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "docker_exporter_api_request_duration_seconds",
+			Help:    "latency of the docker api requests by endpoint (ping, list, stats, inspect, info, disk_usage, images, events), events until the first event or error.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+			[]string{"docker_host", "endpoint"}),
+		collectorDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_exporter_collector_duration_seconds",
+			Help: "time the collector spent on all containers in the last collect, stats covers cpu, memory and network."},
+			[]string{"docker_host", "collector"}),
+		collectorSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_exporter_collector_success",
+			Help: "whether the collector succeeded for every container in the last collect."},
+			[]string{"docker_host", "collector"}),
+		statsErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "docker_container_stats_errors_total",
+			Help: "the number of failed container collections by reason (timeout, stats_request, stats_read, stats_decode, id_mismatch, inspect)."},
+			[]string{"docker_host", "container_name", "container_id", "reason"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_exporter_last_success_timestamp_seconds",
+			Help: "timestamp of the last successful collect of the docker daemon."},
+			[]string{"docker_host"}),
+	}
+}
+
+// observeAPI records the latency of a docker api request started at start.
+func (m *dockerMetrics) observeAPI(dockerHost, endpoint string, start time.Time) {
+	m.apiDuration.WithLabelValues(dockerHost, endpoint).Observe(time.Since(start).Seconds())
+}
+
+// collectorMetrics are the series of a collector, dropped while it is disabled.
+func (m *dockerMetrics) collectorMetrics(name string) []interface{ Reset() } {
+	switch name {
+	case "cpu":
+		return []interface{ Reset() }{m.cpuUser, m.cpuKernel, m.cpuAll, m.cpuSystem}
+	case "memory":
+		return []interface{ Reset() }{m.memoryLimit, m.memoryUsage, m.memoryRss}
+	case "network":
+		return []interface{ Reset() }{m.rxBytes, m.rxPackets, m.txBytes, m.txPackets}
+	case "blkio":
+		return []interface{ Reset() }{m.blkioBytes, m.blkioOps}
+	case "pids":
+		return []interface{ Reset() }{m.pidsCurrent, m.pidsLimit}
+	case "sockets":
+		return []interface{ Reset() }{m.tcpConnections, m.tcpListen, m.sockstat}
+	case "netinfo":
+		return []interface{ Reset() }{m.networkInfo}
+	case "state":
+		return []interface{ Reset() }{m.state, m.restartCount, m.startedAt}
+	case "health":
+		return []interface{ Reset() }{m.healthStatus, m.healthFailing}
+	case "daemon":
+		return []interface{ Reset() }{m.daemonInfo, m.daemonContainers, m.daemonImages}
+	case "disk-usage":
+		return []interface{ Reset() }{m.diskUsage, m.diskUsageObjects}
+	case "images":
+		return []interface{ Reset() }{m.imageSize, m.imageCreated}
+	case "events":
+		return []interface{ Reset() }{m.events}
+	}
+	return nil
+}
+
+// containerMetrics are the metrics with series per container.
+func (m *dockerMetrics) containerMetrics() []deletableVec {
+	return []deletableVec{
+		m.memoryLimit, m.memoryUsage, m.memoryRss,
+		m.cpuUser, m.cpuKernel, m.cpuAll, m.cpuSystem,
+		m.rxBytes, m.rxPackets, m.txBytes, m.txPackets,
+		m.networkInfo, m.tcpConnections, m.tcpListen, m.sockstat,
+		m.blkioBytes, m.blkioOps, m.pidsCurrent, m.pidsLimit,
+		m.state, m.restartCount, m.startedAt, m.healthStatus, m.healthFailing,
+		m.statsErrors,
+	}
+}
+
+// deleteContainers deletes the series of the containers of dockerHost that
+// are neither running nor stopped, by short id. Stopped containers keep the
+// series of the state collector and the label info.
+func (m *dockerMetrics) deleteContainers(dockerHost string, running, stopped map[string]bool) {
+	staleFor := func(keep func(id string) bool) func(prometheus.Labels) bool {
+		return func(labels prometheus.Labels) bool {
+			id, ok := labels["container_id"]
+			return ok && labels["docker_host"] == dockerHost && !keep(id)
+		}
+	}
+	isRunning := func(id string) bool { return running[id] }
+	isListed := func(id string) bool { return running[id] || stopped[id] }
+	for _, vec := range m.containerMetrics() {
+		if vec == m.state || vec == m.restartCount || vec == m.startedAt {
+			deleteSeries(vec, staleFor(isListed))
+		} else {
+			deleteSeries(vec, staleFor(isRunning))
+		}
+	}
+	// probes collect into their own registry without the label info
+	if m == metrics {
+		containerLabels.deleteSeries(staleFor(isListed))
+	}
+}
+
+// deletableVec is a metric vector whose series can be deleted by labels.
+type deletableVec interface {
+	prometheus.Collector
+	Delete(prometheus.Labels) bool
+}
+
+// deleteSeries deletes the series of vec whose labels match.
+func deleteSeries(vec deletableVec, match func(prometheus.Labels) bool) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	var stale []prometheus.Labels
+	for metric := range ch {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			continue
+		}
+		labels := make(prometheus.Labels, len(pb.Label))
+		for _, pair := range pb.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if match(labels) {
+			stale = append(stale, labels)
+		}
+	}
+	for _, labels := range stale {
+		vec.Delete(labels)
+	}
+}
+
+// register registers all metrics of the set on r.
+func (m *dockerMetrics) register(r prometheus.Registerer) {
+	r.MustRegister(m.memoryLimit)
+	r.MustRegister(m.memoryUsage)
+	r.MustRegister(m.memoryRss)
+	r.MustRegister(m.cpuUser)
+	r.MustRegister(m.cpuKernel)
+	r.MustRegister(m.cpuAll)
+	r.MustRegister(m.cpuSystem)
+	r.MustRegister(m.rxBytes)
+	r.MustRegister(m.rxPackets)
+	r.MustRegister(m.txBytes)
+	r.MustRegister(m.txPackets)
+	r.MustRegister(m.networkInfo)
+	r.MustRegister(m.tcpConnections)
+	r.MustRegister(m.tcpListen)
+	r.MustRegister(m.sockstat)
+	r.MustRegister(m.blkioBytes)
+	r.MustRegister(m.blkioOps)
+	r.MustRegister(m.pidsCurrent)
+	r.MustRegister(m.pidsLimit)
+	r.MustRegister(m.state)
+	r.MustRegister(m.restartCount)
+	r.MustRegister(m.startedAt)
+	r.MustRegister(m.healthStatus)
+	r.MustRegister(m.healthFailing)
+	r.MustRegister(m.daemonInfo)
+	r.MustRegister(m.daemonContainers)
+	r.MustRegister(m.daemonImages)
+	r.MustRegister(m.diskUsage)
+	r.MustRegister(m.diskUsageObjects)
+	r.MustRegister(m.imageSize)
+	r.MustRegister(m.imageCreated)
+	r.MustRegister(m.events)
+	r.MustRegister(m.scrapeNumber)
+	r.MustRegister(m.statsNumber)
+	r.MustRegister(m.dockerHostUp)
+	r.MustRegister(m.dockerHostErrors)
+	r.MustRegister(m.apiDuration)
+	r.MustRegister(m.collectorDuration)
+	r.MustRegister(m.collectorSuccess)
+	r.MustRegister(m.statsErrors)
+	r.MustRegister(m.lastSuccess)
+}
+
 var (
-	memoryLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_memory_stats_limit",
-		Help: "Memory Limit.",
-	},
-		[]string{"container_name", "container_id"})
-	memoryUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_memory_stats_usage",
-		Help: "Total memory usage, include Virtual Memory Size.",
-	},
-		[]string{"container_name", "container_id"})
-	memoryRss = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_memory_stats_rss",
-		Help: "Resident Memory Size.",
-	},
-		[]string{"container_name", "container_id"})
-	cpuUser = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_cpu_stats_usermode",
-		Help: "time running un-niced user processes.",
-	},
-		[]string{"container_name", "container_id"})
-	cpuKernel = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_cpu_stats_kernelmode",
-		Help: "time running kernel processes.",
-	},
-		[]string{"container_name", "container_id"})
-	cpuAll = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_cpu_stats_all",
-		Help: "total cpu time for container.",
-	},
-		[]string{"container_name", "container_id"})
-	cpuSystem = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_cpu_stats_system",
-		Help: "host total cpu time.",
-	},
-		[]string{"container_name", "container_id"})
-	rxBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_networks_rx_bytes",
-		Help: "network received bytes.",
-	},
-		[]string{"container_name", "container_id", "interface"})
-	rxPackets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_networks_rx_packets",
-		Help: "network received packets.",
-	},
-		[]string{"container_name", "container_id", "interface"})
-	txBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_networks_tx_bytes",
-		Help: "network send bytes.",
-	},
-		[]string{"container_name", "container_id", "interface"})
-	txPackets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "docker_container_networks_tx_packets",
-		Help: "network send packets.",
-	},
-		[]string{"container_name", "container_id", "interface"})
-	scrapeNumber = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "docker_container_scrape_total",
-		Help: "the number of scrape."})
-	statsNumber = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "docker_container_stats_num",
-		Help: "The amount of docker container stats"})
+	metrics                      = newDockerMetrics()
 	registry                     = prometheus.NewRegistry()
 	gather   prometheus.Gatherer = registry
 	handler                      = promhttp.HandlerFor(gather, promhttp.HandlerOpts{})
@@ -77,17 +425,7 @@ func init() {
 	// log.SetLevel(log.DebugLevel)
 
 	// Metrics have to be registered to be exposed:
-	registry.MustRegister(memoryLimit)
-	registry.MustRegister(memoryUsage)
-	registry.MustRegister(memoryRss)
-	registry.MustRegister(cpuUser)
-	registry.MustRegister(cpuKernel)
-	registry.MustRegister(cpuAll)
-	registry.MustRegister(cpuSystem)
-	registry.MustRegister(rxBytes)
-	registry.MustRegister(rxPackets)
-	registry.MustRegister(txBytes)
-	registry.MustRegister(txPackets)
-	registry.MustRegister(scrapeNumber)
-	registry.MustRegister(statsNumber)
+	metrics.register(registry)
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(os.Getpid(), ""))
 }
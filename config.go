@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli"
+)
+
+// collector is a named group of metrics switched with --collector.<name>
+// and --no-collector.<name>.
+type collector struct {
+	name        string
+	description string
+	// opt-in collectors are disabled by default
+	enabled bool
+}
+
+// collectors are in the order of the flags, the container stats api serves
+// cpu to pids, the container inspect sockets to health.
+var collectors = []collector{
+	{"cpu", "container cpu usage from the stats api", true},
+	{"memory", "container memory usage from the stats api", true},
+	{"network", "container network traffic from the stats api", true},
+	{"blkio", "container block io from the stats api", true},
+	{"pids", "container process count and limit from the stats api", true},
+	{"sockets", "tcp sockets of the container network namespace", true},
+	{"netinfo", "container interfaces with host veth, network and ip", true},
+	{"state", "container state, restarts and start time from inspect", true},
+	{"health", "container HEALTHCHECK status from inspect", true},
+	{"daemon", "docker daemon version and container counts from the info api", true},
+	{"disk-usage", "space used by images, containers, volumes and build cache, expensive", false},
+	{"images", "size and age of every image", false},
+	{"events", "docker events by type and action, a long running events request per daemon", false},
+}
+
+// collectorNames are the names of all collectors.
+var collectorNames = func() []string {
+	var names []string
+	for _, c := range collectors {
+		names = append(names, c.name)
+	}
+	return names
+}()
+
+// defaultCollectors are the collectors enabled by the flags, set up by before.
+var defaultCollectors = make(map[string]bool)
+
+// collectorFlags are --collector.<name> and --no-collector.<name> of every collector.
+func collectorFlags() []cli.Flag {
+	var flags []cli.Flag
+	for _, c := range collectors {
+		env := strings.ToUpper(strings.Replace(c.name, "-", "_", -1))
+		state := "enabled"
+		if !c.enabled {
+			state = "disabled"
+		}
+		flags = append(flags,
+			cli.BoolFlag{
+				EnvVar: "COLLECTOR_" + env,
+				Name:   "collector." + c.name,
+				Usage:  fmt.Sprintf("enable the %s collector: %s (default: %s)", c.name, c.description, state),
+			},
+			cli.BoolFlag{
+				EnvVar: "NO_COLLECTOR_" + env,
+				Name:   "no-collector." + c.name,
+				Usage:  fmt.Sprintf("disable the %s collector", c.name),
+			})
+	}
+	return flags
+}
+
+// setDefaultCollectors enables the collectors of the flags.
+func setDefaultCollectors(c *cli.Context) error {
+	for _, collector := range collectors {
+		enable, disable := c.Bool("collector."+collector.name), c.Bool("no-collector."+collector.name)
+		if enable && disable {
+			return fmt.Errorf("--collector.%s and --no-collector.%s are both set", collector.name, collector.name)
+		}
+		defaultCollectors[collector.name] = (collector.enabled || enable) && !disable
+	}
+	return nil
+}
+
+// runtimeConfig is the exporter behaviour that can change without a restart.
+type runtimeConfig struct {
+	CollectInterval time.Duration `yaml:"collect_interval"`
+	// container name regular expressions, a container is collected when it
+	// matches an include expression, or there are none, and no exclude expression
+	Include stringList `yaml:"include"`
+	Exclude stringList `yaml:"exclude"`
+	// enabled collectors, the --collector flags when empty
+	Collectors stringList `yaml:"collectors"`
+	// container label to metric label of docker_container_labels
+	LabelMappings map[string]string `yaml:"label_mappings"`
+
+	include    []*regexp.Regexp
+	exclude    []*regexp.Regexp
+	collectors map[string]bool
+	// containers selected by the request of an on demand collection
+	selectors []containerSelector
+}
+
+// stringList is a YAML list or a comma separated string.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*l = list
+		return nil
+	}
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+var metricLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// compile validates the configuration and prepares the matchers.
+func (c *runtimeConfig) compile() error {
+	if c.CollectInterval < time.Second {
+		return fmt.Errorf("collect_interval %s is shorter than 1s", c.CollectInterval)
+	}
+
+	c.include, c.exclude = nil, nil
+	for _, expr := range c.Include {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("include %q: %s", expr, err)
+		}
+		c.include = append(c.include, re)
+	}
+	for _, expr := range c.Exclude {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("exclude %q: %s", expr, err)
+		}
+		c.exclude = append(c.exclude, re)
+	}
+
+	c.collectors = make(map[string]bool)
+	for _, name := range c.Collectors {
+		if !contains(collectorNames, name) {
+			return fmt.Errorf("unknown collector %q, use %s", name, strings.Join(collectorNames, ", "))
+		}
+		c.collectors[name] = true
+	}
+
+	seen := make(map[string]string)
+	for label, name := range c.LabelMappings {
+		if !metricLabelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("label mapping %s: invalid metric label %q", label, name)
+		}
+		switch name {
+		case "docker_host", "container_name", "container_id":
+			return fmt.Errorf("label mapping %s: metric label %s is reserved", label, name)
+		}
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("label mappings %s and %s both map to %s", label, other, name)
+		}
+		seen[name] = label
+	}
+	return nil
+}
+
+// collectContainer reports whether the container name passes the filters.
+func (c *runtimeConfig) collectContainer(name string) bool {
+	for _, re := range c.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(c.include) == 0 {
+		return true
+	}
+	for _, re := range c.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectContainer reports whether the container passes the filters and the selectors.
+func (c *runtimeConfig) selectContainer(container types.Container) bool {
+	if !c.collectContainer(container.Names[0][1:]) {
+		return false
+	}
+	for _, selector := range c.selectors {
+		if !selector.matches(container) {
+			return false
+		}
+	}
+	return true
+}
+
+// withSelection is a copy of the configuration running only collectors, the
+// configured ones when empty, on the containers matching selectors.
+func (c *runtimeConfig) withSelection(collectors []string, selectors []containerSelector) (*runtimeConfig, error) {
+	config := *c
+	if len(collectors) > 0 {
+		config.collectors = make(map[string]bool)
+		for _, name := range collectors {
+			if !contains(collectorNames, name) {
+				return nil, fmt.Errorf("unknown collector %q, use %s", name, strings.Join(collectorNames, ", "))
+			}
+			config.collectors[name] = true
+		}
+	}
+	config.selectors = selectors
+	return &config, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// collectorEnabled reports whether the collector name runs.
+func (c *runtimeConfig) collectorEnabled(name string) bool {
+	if len(c.collectors) == 0 {
+		return defaultCollectors[name]
+	}
+	return c.collectors[name]
+}
+
+// anyCollectorEnabled reports whether one of names runs.
+func (c *runtimeConfig) anyCollectorEnabled(names []string) bool {
+	for _, name := range names {
+		if c.collectorEnabled(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// enabledCollectors are the names of the collectors that run.
+func (c *runtimeConfig) enabledCollectors() []string {
+	var names []string
+	for _, name := range collectorNames {
+		if c.collectorEnabled(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+var (
+	runtimeConfigMu      sync.RWMutex
+	currentRuntimeConfig = &runtimeConfig{CollectInterval: 30 * time.Second}
+)
+
+// getRuntimeConfig returns the configuration in effect, it must not be modified.
+func getRuntimeConfig() *runtimeConfig {
+	runtimeConfigMu.RLock()
+	defer runtimeConfigMu.RUnlock()
+	return currentRuntimeConfig
+}
+
+// setRuntimeConfig validates config and puts it in effect.
+func setRuntimeConfig(config *runtimeConfig) error {
+	if err := config.compile(); err != nil {
+		return err
+	}
+	if err := containerLabels.update(config.LabelMappings); err != nil {
+		return err
+	}
+	runtimeConfigMu.Lock()
+	currentRuntimeConfig = config
+	runtimeConfigMu.Unlock()
+	return nil
+}
+
+// containerLabels exports docker_container_labels, its label names follow the
+// label mappings so the metric is replaced whenever they change.
+var containerLabels = &containerLabelInfo{}
+
+type containerLabelInfo struct {
+	mu sync.Mutex
+	// container labels sorted, and the metric label of each
+	labels []string
+	names  []string
+	vec    *prometheus.GaugeVec
+}
+
+func (l *containerLabelInfo) update(mappings map[string]string) error {
+	labels := make([]string, 0, len(mappings))
+	for label := range mappings {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	names := make([]string, 0, len(labels))
+	for _, label := range labels {
+		names = append(names, mappings[label])
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if strings.Join(labels, "\n") == strings.Join(l.labels, "\n") && strings.Join(names, "\n") == strings.Join(l.names, "\n") {
+		return nil
+	}
+
+	var vec *prometheus.GaugeVec
+	if len(labels) > 0 {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "docker_container_labels",
+			Help: "the mapped docker labels of the container.",
+		}, append([]string{"docker_host", "container_name", "container_id"}, names...))
+	}
+	if l.vec != nil {
+		registry.Unregister(l.vec)
+	}
+	if vec != nil {
+		if err := registry.Register(vec); err != nil {
+			return err
+		}
+	}
+	l.labels, l.names, l.vec = labels, names, vec
+	return nil
+}
+
+// deleteSeries deletes the series whose labels match.
+func (l *containerLabelInfo) deleteSeries(match func(prometheus.Labels) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.vec != nil {
+		deleteSeries(l.vec, match)
+	}
+}
+
+// set exports the mapped labels of a container.
+func (l *containerLabelInfo) set(dockerHost, containerName, shortID string, containerLabels map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.vec == nil {
+		return
+	}
+	values := []string{dockerHost, containerName, shortID}
+	for _, label := range l.labels {
+		values = append(values, containerLabels[label])
+	}
+	l.vec.WithLabelValues(values...).Set(1)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// keys of the configuration file that are not flags but runtime configuration
+var configFileRuntimeKeys = map[string]bool{"include": true, "exclude": true, "collectors": true, "label_mappings": true}
+
+var (
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "config_last_reload_successful",
+		Help: "whether the last --config.file reload was valid and applied."})
+	configLastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "config_last_reload_success_timestamp_seconds",
+		Help: "timestamp of the last applied --config.file."})
+)
+
+// configFile is the --config.file: every flag by its name, a list for the
+// repeatable ones, and the include, exclude, collectors and label_mappings
+// of the runtime configuration, e.g.
+//
+//	collect-interval: 30s
+//	docker-endpoint: [unix:///var/run/docker.sock?name=local]
+//	exclude: [^buildkit_]
+type configFile struct {
+	flags   map[string][]string
+	runtime runtimeConfig
+}
+
+// loadConfigFile reads and validates the configuration file.
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %s", path, err)
+	}
+
+	// every flag on a throwaway flag set checks the values
+	set := flag.NewFlagSet("config.file", flag.ContinueOnError)
+	set.SetOutput(ioutil.Discard)
+	slices := make(map[string]bool)
+	for _, f := range flags {
+		f.Apply(set)
+		if _, ok := f.(cli.StringSliceFlag); ok {
+			slices[f.GetName()] = true
+		}
+	}
+
+	file := &configFile{flags: make(map[string][]string)}
+	runtime := make(map[string]interface{})
+	for key, value := range raw {
+		if configFileRuntimeKeys[key] {
+			runtime[key] = value
+			continue
+		}
+		if key == "config.file" || set.Lookup(key) == nil {
+			return nil, fmt.Errorf("config file %s: unknown key %s", path, key)
+		}
+		var values []string
+		switch value := value.(type) {
+		case []interface{}:
+			if !slices[key] {
+				return nil, fmt.Errorf("config file %s: %s takes a single value", path, key)
+			}
+			for _, item := range value {
+				values = append(values, fmt.Sprint(item))
+			}
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("config file %s: %s takes a value, not a map", path, key)
+		case nil:
+			continue
+		default:
+			values = []string{fmt.Sprint(value)}
+		}
+		for _, v := range values {
+			if err := set.Set(key, v); err != nil {
+				return nil, fmt.Errorf("config file %s: %s %q: %s", path, key, v, err)
+			}
+		}
+		file.flags[key] = values
+	}
+
+	data, err = yaml.Marshal(runtime)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, &file.runtime); err != nil {
+		return nil, fmt.Errorf("config file %s: %s", path, err)
+	}
+	return file, nil
+}
+
+// configReloader reloads the configuration file on SIGHUP and /-/reload.
+// Only the runtime configuration takes effect without a restart, an invalid
+// file keeps the last good one.
+type configReloader struct {
+	path string
+	// flags of the command line or the environment, they win over the file
+	overridden map[string]bool
+	// collect interval when the file has none
+	collectInterval time.Duration
+	// puts the runtime configuration in effect
+	apply func(runtimeConfig) error
+
+	mu      sync.Mutex
+	current *configFile
+}
+
+// fileConfig is the loaded --config.file, nil without one.
+var fileConfig *configReloader
+
+// newConfigReloader sets the flags of the file that are not set otherwise.
+func newConfigReloader(c *cli.Context, path string) (*configReloader, error) {
+	file, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &configReloader{
+		path:            path,
+		overridden:      make(map[string]bool),
+		collectInterval: c.Duration("collect-interval"),
+		apply: func(config runtimeConfig) error {
+			return setRuntimeConfig(&config)
+		},
+		current: file,
+	}
+	for name := range file.flags {
+		r.overridden[name] = c.IsSet(name)
+	}
+	for name, values := range file.flags {
+		if r.overridden[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := c.Set(name, value); err != nil {
+				return nil, fmt.Errorf("config file %s: %s", path, err)
+			}
+		}
+	}
+
+	registry.MustRegister(configLastReloadSuccessful)
+	registry.MustRegister(configLastReloadSuccess)
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccess.SetToCurrentTime()
+	return r, nil
+}
+
+// runtimeConfig is the runtime configuration of the loaded file.
+func (r *configReloader) runtimeConfig() runtimeConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fileRuntimeConfig(r.current)
+}
+
+func (r *configReloader) fileRuntimeConfig(file *configFile) runtimeConfig {
+	config := file.runtime
+	config.CollectInterval = r.collectInterval
+	if values, ok := file.flags["collect-interval"]; ok && !r.overridden["collect-interval"] {
+		// checked by loadConfigFile
+		config.CollectInterval, _ = time.ParseDuration(values[0])
+	}
+	return config
+}
+
+// reload loads the file again and applies the runtime configuration, flags
+// that changed are logged as they need a restart.
+func (r *configReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file, err := loadConfigFile(r.path)
+	if err == nil {
+		err = r.apply(r.fileRuntimeConfig(file))
+	}
+	if err != nil {
+		configLastReloadSuccessful.Set(0)
+		log.WithField("file", r.path).WithError(err).Error("Invalid configuration file, keep the last good one")
+		return err
+	}
+
+	var changed []string
+	for name := range r.current.flags {
+		if _, ok := file.flags[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	for name, values := range file.flags {
+		if strings.Join(values, "\n") != strings.Join(r.current.flags[name], "\n") {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	for _, name := range changed {
+		if name != "collect-interval" && !r.overridden[name] {
+			log.WithFields(log.Fields{"file": r.path, "flag": name}).Warn("Configuration file flag changed, it takes effect after a restart")
+		}
+	}
+
+	r.current = file
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccess.SetToCurrentTime()
+	log.WithField("file", r.path).Info("Reload configuration file")
+	return nil
+}
+
+// reloadHandler serves /-/reload, a POST or PUT reloads the configuration file.
+func reloadHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" && request.Method != "PUT" {
+		writer.Header().Set("Allow", "POST, PUT")
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if fileConfig == nil {
+		http.Error(writer, "no --config.file to reload", http.StatusBadRequest)
+		return
+	}
+	if err := fileConfig.reload(); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(writer, "configuration reloaded")
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	consulMinBackoff = time.Second
+	consulMaxBackoff = 2 * time.Minute
+	// timeout of a Consul agent request but blocking queries
+	consulRequestTimeout = 10 * time.Second
+)
+
+var (
+	consulRegistrationUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_registration_up",
+		Help: "whether the service is registered in the Consul agent."})
+	consulRegistrationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consul_registration_errors_total",
+		Help: "the number of failed Consul registrations and checks."})
+)
+
+// consulManager keeps the service registered in Consul. It retries with
+// exponential backoff while Consul is unreachable and registers the service
+// again when the agent lost it, e.g. after a restart without persisted state.
+type consulManager struct {
+	consul       *consulConnector
+	registration *api.AgentServiceRegistration
+	// how often the agent is checked for the service
+	interval time.Duration
+
+	// renders the tags and meta on freshly gathered host facts
+	describe func() ([]string, map[string]string, error)
+	// the agent has older tags and meta
+	outdated bool
+
+	// ttlCheckID is set when the check is a TTL check updated by reportHealth
+	ttlCheckID string
+	healthMu   sync.Mutex
+	status     string
+	note       string
+
+	// result of the last registration check
+	registered bool
+	lastErr    error
+}
+
+func newConsulManager(consul *consulConnector, registration *api.AgentServiceRegistration, interval time.Duration) *consulManager {
+	registry.MustRegister(consulRegistrationUp)
+	registry.MustRegister(consulRegistrationErrors)
+	m := &consulManager{
+		consul:       consul,
+		registration: registration,
+		interval:     interval,
+	}
+	if check := registration.Check; check != nil && check.TTL != "" {
+		m.ttlCheckID = check.CheckID
+	}
+	return m
+}
+
+// run keeps the service registered until ctx is done.
+func (m *consulManager) run(ctx context.Context) {
+	backoff := consulMinBackoff
+	for {
+		wait := m.interval
+		err := m.ensureRegistered()
+		m.healthMu.Lock()
+		m.registered, m.lastErr = err == nil, err
+		m.healthMu.Unlock()
+		if err != nil {
+			consulRegistrationUp.Set(0)
+			consulRegistrationErrors.Inc()
+			log.WithField("retry_in", backoff).WithError(err).Error("Consul registration error")
+			m.consul.failover()
+			wait = backoff
+			backoff *= 2
+			if backoff > consulMaxBackoff {
+				backoff = consulMaxBackoff
+			}
+		} else {
+			consulRegistrationUp.Set(1)
+			backoff = consulMinBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// ensureRegistered registers the service unless the agent already knows it
+// with the current tags and meta.
+func (m *consulManager) ensureRegistered() error {
+	if m.describe != nil {
+		tags, meta, err := m.describe()
+		if err != nil {
+			log.WithField("service_id", m.registration.ID).WithError(err).Warn("Render Consul service tags and meta error")
+		} else if !reflect.DeepEqual(tags, m.registration.Tags) || !reflect.DeepEqual(meta, m.registration.Meta) {
+			log.WithField("service_id", m.registration.ID).Info("Host facts changed, update Consul service")
+			m.registration.Tags, m.registration.Meta = tags, meta
+			m.outdated = true
+		}
+	}
+
+	client, err := m.consul.client()
+	if err != nil {
+		return err
+	}
+	services, err := client.Agent().Services()
+	if err != nil {
+		return err
+	}
+	if _, ok := services[m.registration.ID]; ok && !m.outdated {
+		return nil
+	}
+
+	if err := client.Agent().ServiceRegister(m.registration); err != nil {
+		return err
+	}
+	m.outdated = false
+	log.WithFields(log.Fields{
+		"service_name":    m.registration.Name,
+		"service_id":      m.registration.ID,
+		"service_address": m.registration.Address,
+		"service_port":    m.registration.Port,
+	}).Info("Register Consul service")
+
+	// a new TTL check starts critical, restore the last reported health
+	m.healthMu.Lock()
+	status, note := m.status, m.note
+	m.healthMu.Unlock()
+	if m.ttlCheckID != "" && status != "" {
+		m.updateTTL(client, status, note)
+	}
+	return nil
+}
+
+func (m *consulManager) registrationStatus() (bool, error) {
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	return m.registered, m.lastErr
+}
+
+// reportHealth sets the TTL check to the collection health.
+func (m *consulManager) reportHealth(status, note string) {
+	if m.ttlCheckID == "" {
+		return
+	}
+	m.healthMu.Lock()
+	m.status, m.note = status, note
+	m.healthMu.Unlock()
+
+	client, err := m.consul.client()
+	if err != nil {
+		log.WithField("check_id", m.ttlCheckID).WithError(err).Warn("Update Consul TTL check error")
+		return
+	}
+	m.updateTTL(client, status, note)
+}
+
+func (m *consulManager) updateTTL(client *api.Client, status, note string) {
+	if err := client.Agent().UpdateTTL(m.ttlCheckID, note, status); err != nil {
+		log.WithField("check_id", m.ttlCheckID).WithError(err).Warn("Update Consul TTL check error")
+		return
+	}
+	log.WithFields(log.Fields{"check_id": m.ttlCheckID, "status": status}).Debug("Update Consul TTL check")
+}
+
+// deregister removes the service from Consul, trying every agent address
+// until one succeeds.
+func (m *consulManager) deregister() error {
+	var err error
+	for i := 0; i < len(m.consul.addresses); i++ {
+		var client *api.Client
+		client, err = m.consul.client()
+		if err == nil {
+			err = client.Agent().ServiceDeregister(m.registration.ID)
+		}
+		if err == nil {
+			m.healthMu.Lock()
+			m.registered = false
+			m.healthMu.Unlock()
+			consulRegistrationUp.Set(0)
+			log.WithFields(log.Fields{"service_name": m.registration.Name, "service_id": m.registration.ID}).Info("Deregister Consul service")
+			return nil
+		}
+		log.WithField("service_id", m.registration.ID).WithError(err).Error("Deregister Consul service error")
+		m.consul.failover()
+	}
+	return err
+}
+
+// consulConnector hands out Consul clients. It fails over between the agent
+// addresses and creates a new client when the token file was rotated.
+type consulConnector struct {
+	mu sync.Mutex
+
+	addresses  []string
+	datacenter string
+	token      string
+	tokenFile  string
+	httpAuth   *api.HttpBasicAuth
+	tlsConfig  api.TLSConfig
+	// timeout of a request, 0 for blocking queries bounded by their context
+	timeout time.Duration
+
+	current      int
+	tokenModTime time.Time
+	consulClient *api.Client
+}
+
+// client returns the client of the current agent address.
+func (c *consulConnector) client() (*api.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokenFile != "" {
+		info, err := os.Stat(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if !info.ModTime().Equal(c.tokenModTime) {
+			data, err := ioutil.ReadFile(c.tokenFile)
+			if err != nil {
+				return nil, err
+			}
+			if c.tokenModTime.IsZero() {
+				log.WithField("file", c.tokenFile).Info("Read Consul token")
+			} else {
+				log.WithField("file", c.tokenFile).Info("Consul token file changed, reload token")
+			}
+			c.token = strings.TrimSpace(string(data))
+			c.tokenModTime = info.ModTime()
+			c.consulClient = nil
+		}
+	}
+
+	if c.consulClient != nil {
+		return c.consulClient, nil
+	}
+
+	config := api.DefaultConfig()
+	config.Address = c.addresses[c.current]
+	config.Datacenter = c.datacenter
+	config.Token = c.token
+	config.HttpAuth = c.httpAuth
+	config.TLSConfig = c.tlsConfig
+	if c.tlsConfig.CAFile != "" || c.tlsConfig.CertFile != "" || c.tlsConfig.InsecureSkipVerify {
+		config.Scheme = "https"
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	// the client shares the http client, a hung agent must not block shutdown
+	config.HttpClient.Timeout = c.timeout
+	c.consulClient = client
+	return client, nil
+}
+
+// failover switches to the next agent address.
+func (c *consulConnector) failover() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.addresses) < 2 {
+		return
+	}
+	c.current = (c.current + 1) % len(c.addresses)
+	c.consulClient = nil
+	log.WithField("consul_address", c.addresses[c.current]).Warn("Fail over to Consul agent")
+}
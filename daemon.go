@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// daemonToMetrics exports the version and the container and image counts of
+// the daemon.
+func (s *dockerScraper) daemonToMetrics(ctx context.Context) error {
+	m := s.metrics
+	start := time.Now()
+	info, err := s.client.Info(ctx)
+	m.observeAPI(s.name, "info", start)
+	if err != nil {
+		return err
+	}
+	m.daemonInfo.WithLabelValues(s.name, info.ServerVersion, info.OperatingSystem, info.KernelVersion, info.Driver).Set(1)
+	m.daemonContainers.WithLabelValues(s.name, "running").Set(float64(info.ContainersRunning))
+	m.daemonContainers.WithLabelValues(s.name, "paused").Set(float64(info.ContainersPaused))
+	m.daemonContainers.WithLabelValues(s.name, "stopped").Set(float64(info.ContainersStopped))
+	m.daemonImages.WithLabelValues(s.name).Set(float64(info.Images))
+	return nil
+}
+
+// diskUsageToMetrics exports the space used by images, containers, volumes
+// and the build cache, the daemon walks the layers to answer.
+func (s *dockerScraper) diskUsageToMetrics(ctx context.Context) error {
+	m := s.metrics
+	start := time.Now()
+	usage, err := s.client.DiskUsage(ctx)
+	m.observeAPI(s.name, "disk_usage", start)
+	if err != nil {
+		return err
+	}
+
+	var containersSize, volumesSize, buildCacheSize int64
+	for _, container := range usage.Containers {
+		containersSize += container.SizeRw
+	}
+	for _, volume := range usage.Volumes {
+		// -1 when the size is unknown
+		if volume.UsageData != nil && volume.UsageData.Size > 0 {
+			volumesSize += volume.UsageData.Size
+		}
+	}
+	for _, cache := range usage.BuildCache {
+		buildCacheSize += cache.Size
+	}
+	m.diskUsage.WithLabelValues(s.name, "images").Set(float64(usage.LayersSize))
+	m.diskUsage.WithLabelValues(s.name, "containers").Set(float64(containersSize))
+	m.diskUsage.WithLabelValues(s.name, "volumes").Set(float64(volumesSize))
+	m.diskUsage.WithLabelValues(s.name, "build_cache").Set(float64(buildCacheSize))
+	m.diskUsageObjects.WithLabelValues(s.name, "images").Set(float64(len(usage.Images)))
+	m.diskUsageObjects.WithLabelValues(s.name, "containers").Set(float64(len(usage.Containers)))
+	m.diskUsageObjects.WithLabelValues(s.name, "volumes").Set(float64(len(usage.Volumes)))
+	m.diskUsageObjects.WithLabelValues(s.name, "build_cache").Set(float64(len(usage.BuildCache)))
+	return nil
+}
+
+// imagesToMetrics exports the size and creation time of every image, removed
+// images are dropped.
+func (s *dockerScraper) imagesToMetrics(ctx context.Context) error {
+	m := s.metrics
+	start := time.Now()
+	images, err := s.client.ImageList(ctx, types.ImageListOptions{})
+	m.observeAPI(s.name, "images", start)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[[2]string]bool)
+	for _, image := range images {
+		id := strings.TrimPrefix(image.ID, "sha256:")
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		repoTag := "<none>:<none>"
+		if len(image.RepoTags) > 0 {
+			repoTag = image.RepoTags[0]
+		}
+		m.imageSize.WithLabelValues(s.name, id, repoTag).Set(float64(image.Size))
+		m.imageCreated.WithLabelValues(s.name, id, repoTag).Set(float64(image.Created))
+		seen[[2]string{id, repoTag}] = true
+	}
+	for image := range s.images {
+		if !seen[image] {
+			m.imageSize.DeleteLabelValues(s.name, image[0], image[1])
+			m.imageCreated.DeleteLabelValues(s.name, image[0], image[1])
+		}
+	}
+	s.images = seen
+	return nil
+}
+
+// syncEvents starts the events request of the daemon when the events
+// collector is enabled and stops it when it is not.
+func (s *dockerScraper) syncEvents(ctx context.Context, enabled bool) {
+	switch {
+	case enabled && s.eventsCancel == nil:
+		eventsCtx, cancel := context.WithCancel(ctx)
+		s.eventsCancel = cancel
+		go s.watchEvents(eventsCtx)
+	case !enabled && s.eventsCancel != nil:
+		s.eventsCancel()
+		s.eventsCancel = nil
+	}
+}
+
+// watchEvents counts the events of the daemon until ctx is done, reconnecting
+// with backoff.
+func (s *dockerScraper) watchEvents(ctx context.Context) {
+	logger := log.WithFields(log.Fields{logFieldDockerHost: s.name, logFieldCollector: "events"})
+	backoff := consulMinBackoff
+	for {
+		start := time.Now()
+		messages, errs := s.client.Events(ctx, types.EventsOptions{})
+		// the stream stays open, its latency is the time to the first message or error
+		observe := func() {
+			if !start.IsZero() {
+				s.metrics.observeAPI(s.name, "events", start)
+				start = time.Time{}
+			}
+		}
+		var err error
+	watch:
+		for {
+			select {
+			case message := <-messages:
+				observe()
+				backoff = consulMinBackoff
+				// health_status: healthy, exec_start: sh -c ...
+				action := strings.SplitN(message.Action, ":", 2)[0]
+				s.metrics.events.WithLabelValues(s.name, message.Type, action).Inc()
+			case err = <-errs:
+				observe()
+				break watch
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logger.WithField("retry_in", backoff).WithError(err).Error("Docker events error")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > consulMaxBackoff {
+			backoff = consulMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+	log "github.com/sirupsen/logrus"
+)
+
+// dockerTarget is a Docker daemon the exporter collects from.
+type dockerTarget struct {
+	// Name is exported as docker_host label, defaults to the daemon host
+	Name       string
+	Host       string
+	APIVersion string
+	TLSCACert  string
+	TLSCert    string
+	TLSKey     string
+	TLSVerify  bool
+	// Timeout of a single docker api request, 0 for none
+	Timeout time.Duration
+}
+
+// parseDockerTarget parses an endpoint like
+//
+//	tcp://build-01:2376?name=build-01&tls-cert-path=/certs/build-01&tls-verify=true&api-version=1.37
+//
+// Supported query parameters are name, api-version, tls-cert-path (a directory
+// with ca.pem, cert.pem and key.pem like DOCKER_CERT_PATH), tls-ca, tls-cert,
+// tls-key, tls-verify and timeout.
+func parseDockerTarget(endpoint string) (dockerTarget, error) {
+	var target dockerTarget
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return target, fmt.Errorf("invalid docker endpoint %q: %s", endpoint, err)
+	}
+	query := u.Query()
+	u.RawQuery = ""
+	target.Host = u.String()
+	target.Name = query.Get("name")
+	target.APIVersion = query.Get("api-version")
+
+	if certPath := query.Get("tls-cert-path"); certPath != "" {
+		target.TLSCACert = filepath.Join(certPath, "ca.pem")
+		target.TLSCert = filepath.Join(certPath, "cert.pem")
+		target.TLSKey = filepath.Join(certPath, "key.pem")
+	}
+	if ca := query.Get("tls-ca"); ca != "" {
+		target.TLSCACert = ca
+	}
+	if cert := query.Get("tls-cert"); cert != "" {
+		target.TLSCert = cert
+	}
+	if key := query.Get("tls-key"); key != "" {
+		target.TLSKey = key
+	}
+	if verify := query.Get("tls-verify"); verify != "" {
+		target.TLSVerify, err = strconv.ParseBool(verify)
+		if err != nil {
+			return target, fmt.Errorf("invalid tls-verify of docker endpoint %q: %s", endpoint, err)
+		}
+	}
+	if timeout := query.Get("timeout"); timeout != "" {
+		target.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return target, fmt.Errorf("invalid timeout of docker endpoint %q: %s", endpoint, err)
+		}
+	}
+
+	return target, nil
+}
+
+// newDockerClient creates a client for target, an empty host falls back to
+// the DOCKER_* environment variables.
+func newDockerClient(target dockerTarget) (*client.Client, error) {
+	if target.Host == "" {
+		return client.NewClientWithOpts(client.FromEnv)
+	}
+
+	var opts []func(*client.Client) error
+	if target.TLSCACert != "" || target.TLSCert != "" || target.TLSKey != "" {
+		tlsc, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             target.TLSCACert,
+			CertFile:           target.TLSCert,
+			KeyFile:            target.TLSKey,
+			InsecureSkipVerify: !target.TLSVerify,
+		})
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport:     &http.Transport{TLSClientConfig: tlsc},
+			CheckRedirect: client.CheckRedirect,
+		}))
+	}
+	opts = append(opts, client.WithHost(target.Host))
+	if target.APIVersion != "" {
+		opts = append(opts, client.WithVersion(target.APIVersion))
+	}
+
+	return client.NewClientWithOpts(opts...)
+}
+
+// dockerScraper collects the containers of one Docker daemon.
+type dockerScraper struct {
+	// name is the docker_host label value
+	name    string
+	client  *client.Client
+	metrics *dockerMetrics
+	timeout time.Duration
+	// the daemon listens on a unix socket of the exporter host, the pids of
+	// its containers are in --procfs
+	local bool
+	// negotiate the api version before the next scrape
+	negotiate bool
+	// called by run after every collect
+	onCollect func(s *dockerScraper, result scrapeResult)
+	// host label values, shared by the scrapers of the configured daemons
+	hosts *hostLabels
+	// stops the events request of the events collector
+	eventsCancel context.CancelFunc
+	// image id and repo tag of the series of the images collector
+	images map[[2]string]bool
+}
+
+// scrapeResult is the outcome of one collect of a docker daemon.
+type scrapeResult struct {
+	time time.Time
+	// error of the container list, the daemon is down
+	err        error
+	containers int
+	// containers whose stats or inspect failed
+	failed int
+}
+
+func newDockerScraper(target dockerTarget, metrics *dockerMetrics) (*dockerScraper, error) {
+	cli, err := newDockerClient(target)
+	if err != nil {
+		return nil, err
+	}
+	name := target.Name
+	if name == "" {
+		name = cli.DaemonHost()
+	}
+	return &dockerScraper{
+		name:      name,
+		client:    cli,
+		metrics:   metrics,
+		timeout:   target.Timeout,
+		local:     strings.HasPrefix(cli.DaemonHost(), "unix://"),
+		hosts:     identity.hosts,
+		negotiate: target.APIVersion == "",
+	}, nil
+}
+
+// run collects the daemon every collect interval until ctx is done, the
+// interval is read again after every collect.
+func (s *dockerScraper) run(ctx context.Context) {
+	for {
+		start := time.Now()
+		config := getRuntimeConfig()
+		s.syncEvents(ctx, config.collectorEnabled("events"))
+		result := s.collect(ctx, config)
+		if s.onCollect != nil && ctx.Err() == nil {
+			s.onCollect(s, result)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(getRuntimeConfig().CollectInterval - time.Since(start)):
+		}
+	}
+}
+
+// collect scrapes the daemon once with config and records its health.
+func (s *dockerScraper) collect(ctx context.Context, config *runtimeConfig) scrapeResult {
+	m := s.metrics
+	if s.negotiate {
+		s.negotiateAPIVersion(ctx)
+	}
+	s.resolveHost(ctx)
+	result := s.scrape(ctx, config)
+	if result.err != nil {
+		m.dockerHostUp.WithLabelValues(s.name).Set(0)
+		m.dockerHostErrors.WithLabelValues(s.name).Inc()
+	} else {
+		m.dockerHostUp.WithLabelValues(s.name).Set(1)
+		m.lastSuccess.WithLabelValues(s.name).SetToCurrentTime()
+	}
+	return result
+}
+
+// negotiateAPIVersion downgrades the client to the daemon api version, it is
+// retried on the next collect until the daemon answers.
+func (s *dockerScraper) negotiateAPIVersion(ctx context.Context) {
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+	start := time.Now()
+	ping, err := s.client.Ping(ctx)
+	s.metrics.observeAPI(s.name, "ping", start)
+	if err != nil {
+		log.WithField(logFieldDockerHost, s.name).WithError(err).Warn("Ping docker daemon error")
+		return
+	}
+	s.client.NegotiateAPIVersionPing(ping)
+	s.negotiate = false
+	log.WithFields(log.Fields{logFieldDockerHost: s.name, "api_version": s.client.ClientVersion()}).Info("Negotiated docker api version")
+}
+
+// requestContext limits a docker api request to the target timeout.
+func (s *dockerScraper) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout > 0 {
+		return context.WithTimeout(ctx, s.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// scrape collects the stats of the selected running containers and waits for them.
+func (s *dockerScraper) scrape(ctx context.Context, config *runtimeConfig) scrapeResult {
+	m := s.metrics
+	result := scrapeResult{time: time.Now()}
+	logger := log.WithField(logFieldDockerHost, s.name)
+	logger.Info("Get containers stats")
+	listCtx, cancel := s.requestContext(ctx)
+	start := time.Now()
+	// the state collector lists the containers that are not running too
+	containers, err := s.client.ContainerList(listCtx, types.ContainerListOptions{All: config.collectorEnabled("state")})
+	m.observeAPI(s.name, "list", start)
+	cancel()
+	if err != nil {
+		logger.WithError(err).Error("Get container list error")
+		result.err = err
+		return result
+	}
+	filtered := containers[:0]
+	var stopped []types.Container
+	for _, container := range containers {
+		if len(container.Names) == 0 || !config.selectContainer(container) {
+			continue
+		}
+		if contains(runningStates, container.State) {
+			filtered = append(filtered, container)
+		} else {
+			stopped = append(stopped, container)
+		}
+	}
+	containers = filtered
+	result.containers = len(containers)
+	m.scrapeNumber.WithLabelValues(s.name).Inc()
+	m.statsNumber.WithLabelValues(s.name).Set(0)
+
+	results := newCollectorResults()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, container := range containers {
+		wg.Add(1)
+		go func(container types.Container) {
+			defer wg.Done()
+			ctx, cancel := s.requestContext(ctx)
+			defer cancel()
+			if err := containerToMetrics(ctx, m, s.name, s.client, s.local, container, config, results); err != nil {
+				m.dockerHostErrors.WithLabelValues(s.name).Inc()
+				mu.Lock()
+				result.failed++
+				mu.Unlock()
+			}
+		}(container)
+	}
+	wg.Wait()
+	for _, container := range stopped {
+		stoppedContainerToMetrics(m, s.name, container)
+	}
+
+	// containers that are gone or no longer selected, e.g. after an exclude
+	// change, stop exporting their last values, stopped ones keep the state
+	running := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		running[container.ID[:10]] = true
+	}
+	stoppedIDs := make(map[string]bool, len(stopped))
+	for _, container := range stopped {
+		stoppedIDs[container.ID[:10]] = true
+	}
+	m.deleteContainers(s.name, running, stoppedIDs)
+
+	// daemon collectors
+	for _, collector := range []struct {
+		name    string
+		collect func(context.Context) error
+	}{
+		{"daemon", s.daemonToMetrics},
+		{"disk-usage", s.diskUsageToMetrics},
+		{"images", s.imagesToMetrics},
+	} {
+		if !config.collectorEnabled(collector.name) {
+			continue
+		}
+		requestCtx, cancel := s.requestContext(ctx)
+		start := time.Now()
+		err := collector.collect(requestCtx)
+		cancel()
+		if err != nil {
+			logger.WithField(logFieldCollector, collector.name).WithError(err).Error("Collect docker daemon error")
+			m.dockerHostErrors.WithLabelValues(s.name).Inc()
+		}
+		results.observe(logger, collector.name, start, err)
+	}
+	// the series of disabled collectors go away
+	for _, name := range collectorNames {
+		if !config.collectorEnabled(name) {
+			for _, vec := range m.collectorMetrics(name) {
+				vec.Reset()
+			}
+		}
+	}
+
+	results.export(m, s.name)
+	logger.WithFields(log.Fields{
+		"containers":     result.containers,
+		"failed":         result.failed,
+		logFieldDuration: time.Since(result.time).String(),
+	}).Info("Collected containers stats")
+
+	return result
+}
+
+// collectorResults sums the time each collector spent on the containers of
+// one collect and notes the collectors that failed for any of them.
+type collectorResults struct {
+	mu       sync.Mutex
+	duration map[string]time.Duration
+	failed   map[string]bool
+}
+
+func newCollectorResults() *collectorResults {
+	return &collectorResults{
+		duration: make(map[string]time.Duration),
+		failed:   make(map[string]bool),
+	}
+}
+
+// observe records a run of collector started at start for the container of logger.
+func (r *collectorResults) observe(logger *log.Entry, collector string, start time.Time, err error) {
+	duration := time.Since(start)
+	logger.WithFields(log.Fields{logFieldCollector: collector, logFieldDuration: duration.String()}).Debug("Collected container")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.duration[collector] += duration
+	r.failed[collector] = r.failed[collector] || err != nil
+}
+
+func (r *collectorResults) export(m *dockerMetrics, dockerHost string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for collector, duration := range r.duration {
+		m.collectorDuration.WithLabelValues(dockerHost, collector).Set(duration.Seconds())
+		success := 1.0
+		if r.failed[collector] {
+			success = 0
+		}
+		m.collectorSuccess.WithLabelValues(dockerHost, collector).Set(success)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/client"
+	"github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// defaultDockerTarget builds the target used when no --docker-endpoint is
+// given. The host is taken from, in order, --docker-host, the docker CLI
+// context, a rootless docker socket under $XDG_RUNTIME_DIR and the default
+// /var/run/docker.sock.
+func defaultDockerTarget(c *cli.Context) (dockerTarget, error) {
+	target := dockerTarget{
+		Host:       c.String("docker-host"),
+		APIVersion: c.String("docker-api-version"),
+		TLSCACert:  c.String("docker-tls-ca"),
+		TLSCert:    c.String("docker-tls-cert"),
+		TLSKey:     c.String("docker-tls-key"),
+		TLSVerify:  c.Bool("docker-tls-verify"),
+		Timeout:    c.Duration("docker-timeout"),
+	}
+	if certPath := c.String("docker-cert-path"); certPath != "" {
+		if target.TLSCACert == "" {
+			target.TLSCACert = filepath.Join(certPath, "ca.pem")
+		}
+		if target.TLSCert == "" {
+			target.TLSCert = filepath.Join(certPath, "cert.pem")
+		}
+		if target.TLSKey == "" {
+			target.TLSKey = filepath.Join(certPath, "key.pem")
+		}
+	}
+	if target.Host != "" {
+		return target, nil
+	}
+
+	contextName := c.String("docker-context")
+	if contextName == "" {
+		contextName = currentDockerContext()
+	}
+	if contextName != "" && contextName != "default" {
+		contextTarget, err := loadDockerContext(contextName)
+		if err != nil {
+			return target, err
+		}
+		log.WithFields(log.Fields{"docker_context": contextName, logFieldDockerHost: contextTarget.Host}).Info("Use docker context")
+		target.Host = contextTarget.Host
+		if !c.IsSet("docker-tls-verify") {
+			target.TLSVerify = contextTarget.TLSVerify
+		}
+		if target.TLSCACert == "" && target.TLSCert == "" && target.TLSKey == "" {
+			target.TLSCACert = contextTarget.TLSCACert
+			target.TLSCert = contextTarget.TLSCert
+			target.TLSKey = contextTarget.TLSKey
+		}
+		return target, nil
+	}
+
+	target.Host = rootlessDockerHost()
+	if target.Host == "" {
+		target.Host = client.DefaultDockerHost
+	}
+	return target, nil
+}
+
+// rootlessDockerHost returns the rootless docker socket when the rootful one
+// does not exist.
+func rootlessDockerHost() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return ""
+	}
+	if _, err := os.Stat("/var/run/docker.sock"); err == nil {
+		return ""
+	}
+	socket := filepath.Join(runtimeDir, "docker.sock")
+	if _, err := os.Stat(socket); err != nil {
+		return ""
+	}
+	log.WithField("socket", socket).Info("Use rootless docker socket")
+	return "unix://" + socket
+}
+
+// dockerConfigDir returns $DOCKER_CONFIG or ~/.docker.
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// currentDockerContext returns the currentContext of the docker CLI config.
+func currentDockerContext() string {
+	configDir := dockerConfigDir()
+	if configDir == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(filepath.Join(configDir, "config.json"))
+	if err != nil {
+		return ""
+	}
+	var config struct {
+		CurrentContext string `json:"currentContext"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		log.WithField("dir", configDir).WithError(err).Warn("Parse docker config error")
+		return ""
+	}
+	return config.CurrentContext
+}
+
+// loadDockerContext reads a docker CLI context. Contexts are stored in
+// contexts/meta/<sha256 of name>/meta.json, their TLS material in
+// contexts/tls/<sha256 of name>/docker.
+func loadDockerContext(name string) (dockerTarget, error) {
+	var target dockerTarget
+
+	sum := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(sum[:])
+	contextsDir := filepath.Join(dockerConfigDir(), "contexts")
+
+	data, err := ioutil.ReadFile(filepath.Join(contextsDir, "meta", id, "meta.json"))
+	if err != nil {
+		return target, fmt.Errorf("load docker context %s: %s", name, err)
+	}
+	var meta struct {
+		Endpoints map[string]struct {
+			Host          string
+			SkipTLSVerify bool
+		}
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return target, fmt.Errorf("parse docker context %s: %s", name, err)
+	}
+	endpoint, ok := meta.Endpoints["docker"]
+	if !ok || endpoint.Host == "" {
+		return target, fmt.Errorf("docker context %s has no docker endpoint", name)
+	}
+	target.Host = endpoint.Host
+	target.TLSVerify = !endpoint.SkipTLSVerify
+
+	tlsDir := filepath.Join(contextsDir, "tls", id, "docker")
+	for file, path := range map[string]*string{
+		"ca.pem":   &target.TLSCACert,
+		"cert.pem": &target.TLSCert,
+		"key.pem":  &target.TLSKey,
+	} {
+		if _, err := os.Stat(filepath.Join(tlsDir, file)); err == nil {
+			*path = filepath.Join(tlsDir, file)
+		}
+	}
+
+	return target, nil
+}
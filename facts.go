@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"runtime"
+	"text/template"
+	"time"
+
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// serviceFacts describe the exporter and its docker host. They are registered
+// as service meta and can be used in --service-tags and --service-meta
+// templates, e.g. "docker-{{ .DockerVersion }}".
+type serviceFacts struct {
+	Version       string
+	Hostname      string
+	OS            string
+	Kernel        string
+	Arch          string
+	DockerVersion string
+	SwarmNodeID   string
+}
+
+// gatherServiceFacts asks the docker daemon for its facts, falling back to the
+// exporter host when the daemon is unreachable.
+func gatherServiceFacts(cli *client.Client, version string) serviceFacts {
+	facts := serviceFacts{
+		Version: version,
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+	}
+	facts.Hostname, _ = os.Hostname()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	info, err := cli.Info(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Get docker info for service meta error")
+		return facts
+	}
+	facts.Hostname = info.Name
+	facts.OS = info.OperatingSystem
+	facts.Kernel = info.KernelVersion
+	facts.Arch = info.Architecture
+	facts.DockerVersion = info.ServerVersion
+	facts.SwarmNodeID = info.Swarm.NodeID
+	return facts
+}
+
+// meta returns the facts as Consul service meta, empty facts are left out.
+func (f serviceFacts) meta() map[string]string {
+	meta := make(map[string]string)
+	for key, value := range map[string]string{
+		"exporter_version": f.Version,
+		"hostname":         f.Hostname,
+		"os":               f.OS,
+		"kernel":           f.Kernel,
+		"arch":             f.Arch,
+		"docker_version":   f.DockerVersion,
+		"swarm_node_id":    f.SwarmNodeID,
+	} {
+		if value != "" {
+			meta[key] = value
+		}
+	}
+	return meta
+}
+
+// renderServiceTemplate executes text as a Go template on facts.
+func renderServiceTemplate(text string, facts serviceFacts) (string, error) {
+	tmpl, err := template.New("service").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, facts); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
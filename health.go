@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	healthPingTimeout = 5 * time.Second
+	// a collection older than this many intervals is stale
+	healthStaleIntervals = 3
+)
+
+// collectionHealth keeps the last collect result of every docker daemon and
+// serves the /health and /ready endpoints.
+type collectionHealth struct {
+	scrapers []*dockerScraper
+
+	mu          sync.Mutex
+	results     map[string]scrapeResult
+	lastSuccess map[string]time.Time
+}
+
+func newCollectionHealth(scrapers []*dockerScraper) *collectionHealth {
+	return &collectionHealth{
+		scrapers:    scrapers,
+		results:     make(map[string]scrapeResult),
+		lastSuccess: make(map[string]time.Time),
+	}
+}
+
+func (h *collectionHealth) update(dockerHost string, result scrapeResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.results[dockerHost] = result
+	if result.err == nil {
+		h.lastSuccess[dockerHost] = result.time
+	}
+}
+
+// status summarizes the last collects as a Consul check status: passing when
+// every daemon was collected completely, warning when containers failed or
+// some daemons are down and critical when no daemon could be collected.
+func (h *collectionHealth) status() (string, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.results) == 0 {
+		return api.HealthCritical, "no collection yet"
+	}
+
+	hosts := make([]string, 0, len(h.results))
+	for host := range h.results {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var notes []string
+	down, failed := 0, 0
+	for _, host := range hosts {
+		result := h.results[host]
+		switch {
+		case result.err != nil:
+			down++
+			notes = append(notes, fmt.Sprintf("%s: docker daemon error: %s", host, result.err))
+		case result.failed > 0:
+			failed++
+			notes = append(notes, fmt.Sprintf("%s: %d of %d containers failed stats", host, result.failed, result.containers))
+		default:
+			notes = append(notes, fmt.Sprintf("%s: %d containers collected", host, result.containers))
+		}
+	}
+
+	status := api.HealthPassing
+	if down == len(hosts) {
+		status = api.HealthCritical
+	} else if down > 0 || failed > 0 {
+		status = api.HealthWarning
+	}
+	return status, strings.Join(notes, "\n")
+}
+
+// component states of the /health and /ready responses
+const (
+	componentUp       = "up"
+	componentDegraded = "degraded"
+	componentDown     = "down"
+)
+
+type healthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentHealth `json:"components"`
+}
+
+type componentHealth struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	// collection components only
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	AgeSeconds  *float64   `json:"age_seconds,omitempty"`
+	Containers  *int       `json:"containers,omitempty"`
+	Failed      *int       `json:"failed,omitempty"`
+}
+
+// components checks the docker daemons with Ping and reports the collections
+// and the registrar.
+func (h *collectionHealth) components(ctx context.Context) map[string]componentHealth {
+	components := make(map[string]componentHealth)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, scraper := range h.scrapers {
+		wg.Add(1)
+		go func(scraper *dockerScraper) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+			defer cancel()
+			component := componentHealth{Status: componentUp}
+			start := time.Now()
+			_, err := scraper.client.Ping(ctx)
+			scraper.metrics.observeAPI(scraper.name, "ping", start)
+			if err != nil {
+				component = componentHealth{Status: componentDown, Message: err.Error()}
+			}
+			mu.Lock()
+			components["docker/"+scraper.name] = component
+			mu.Unlock()
+		}(scraper)
+	}
+	wg.Wait()
+
+	interval := getRuntimeConfig().CollectInterval
+	h.mu.Lock()
+	now := time.Now()
+	for _, scraper := range h.scrapers {
+		component := componentHealth{Status: componentDown, Message: "no successful collection yet"}
+		if last, ok := h.lastSuccess[scraper.name]; ok {
+			age := now.Sub(last).Seconds()
+			component.LastSuccess = &last
+			component.AgeSeconds = &age
+			if now.Sub(last) > healthStaleIntervals*interval {
+				component.Message = "last successful collection is stale"
+			} else {
+				component.Status = componentUp
+				component.Message = ""
+			}
+		}
+		if result, ok := h.results[scraper.name]; ok {
+			containers, failed := result.containers, result.failed
+			component.Containers = &containers
+			component.Failed = &failed
+			if result.err != nil {
+				component.Message = result.err.Error()
+			} else if failed > 0 && component.Status == componentUp {
+				component.Status = componentDegraded
+				component.Message = fmt.Sprintf("%d of %d containers failed stats", failed, containers)
+			}
+		}
+		components["collection/"+scraper.name] = component
+	}
+	h.mu.Unlock()
+
+	if _, ok := serviceRegistrar.(noneRegistrar); !ok && serviceRegistrar != nil {
+		component := componentHealth{Status: componentUp}
+		if registered, err := serviceRegistrar.registrationStatus(); err != nil {
+			component = componentHealth{Status: componentDown, Message: err.Error()}
+		} else if !registered {
+			component = componentHealth{Status: componentDown, Message: "not registered yet"}
+		}
+		components["registrar"] = component
+	}
+
+	return components
+}
+
+// alive reports whether every collection loop ran recently. Unlike readiness
+// it does not depend on the docker daemons, a restart only helps a stuck loop.
+func (h *collectionHealth) alive() (bool, string) {
+	interval := getRuntimeConfig().CollectInterval
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, scraper := range h.scrapers {
+		result, ok := h.results[scraper.name]
+		if ok && time.Since(result.time) > healthStaleIntervals*interval+healthPingTimeout {
+			return false, fmt.Sprintf("collection of %s is stuck since %s", scraper.name, result.time.Format(time.RFC3339))
+		}
+	}
+	return true, ""
+}
+
+// ready reports whether the exporter serves useful metrics: at least one
+// docker daemon answers and was collected recently.
+func ready(components map[string]componentHealth) bool {
+	for name, component := range components {
+		if strings.HasPrefix(name, "collection/") && component.Status != componentDown {
+			if components["docker/"+strings.TrimPrefix(name, "collection/")].Status == componentUp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handler serves /health (liveness) or /ready (readiness) as JSON, failing with 503.
+func (h *collectionHealth) handler(readiness bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		response := healthResponse{
+			Status:     componentUp,
+			Components: h.components(request.Context()),
+		}
+		for _, component := range response.Components {
+			if component.Status != componentUp {
+				response.Status = componentDegraded
+			}
+		}
+
+		ok := true
+		if readiness {
+			ok = ready(response.Components)
+		} else if alive, message := h.alive(); !alive {
+			ok = false
+			response.Components["liveness"] = componentHealth{Status: componentDown, Message: message}
+		}
+		if !ok {
+			response.Status = componentDown
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Cache-Control", "no-cache,no-store")
+		writer.Header().Set("Server", "prometheus")
+		if !ok {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(response)
+	}
+}
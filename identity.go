@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// labels of the container series a constant label cannot replace
+var reservedLabels = []string{"docker_host", "container_name", "container_id"}
+
+// metricsIdentity renames the docker_ metrics to the namespace and labels
+// every series with the constant labels and the host label, on the
+// background collection, probes, on demand collections and proxied metrics
+// alike.
+type metricsIdentity struct {
+	namespace   string
+	constLabels map[string]string
+	// host or node, empty without host label
+	hostLabel string
+	// exporter hostname, the host label of series without docker daemon
+	hostname string
+	// host labels of the configured docker daemons
+	hosts *hostLabels
+}
+
+// hostLabels are the host label values by docker_host. Probes keep their own
+// so caller supplied targets are not remembered.
+type hostLabels struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func newHostLabels() *hostLabels {
+	return &hostLabels{values: make(map[string]string)}
+}
+
+func (h *hostLabels) get(dockerHost string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	host, ok := h.values[dockerHost]
+	return host, ok
+}
+
+func (h *hostLabels) set(dockerHost, host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.values[dockerHost] = host
+}
+
+// identity is set up by before from the --metrics.* flags.
+var identity = &metricsIdentity{namespace: "docker"}
+
+// newMetricsIdentity validates the --metrics.namespace, --metrics.const-label
+// and --metrics.host-label flags.
+func newMetricsIdentity(c *cli.Context) (*metricsIdentity, error) {
+	i := &metricsIdentity{
+		namespace:   c.String("metrics.namespace"),
+		constLabels: make(map[string]string),
+		hosts:       newHostLabels(),
+	}
+	if i.namespace != "" && !metricLabelName.MatchString(i.namespace) {
+		return nil, fmt.Errorf("invalid --metrics.namespace %q", i.namespace)
+	}
+
+	switch hostLabel := c.String("metrics.host-label"); hostLabel {
+	case "none":
+	case "host", "node":
+		i.hostLabel = hostLabel
+		i.hostname, _ = os.Hostname()
+	default:
+		return nil, fmt.Errorf("--metrics.host-label %q, use host, node or none", hostLabel)
+	}
+
+	for _, label := range c.StringSlice("metrics.const-label") {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || !metricLabelName.MatchString(parts[0]) || strings.HasPrefix(parts[0], "__") {
+			return nil, fmt.Errorf("invalid --metrics.const-label %q, use name=value", label)
+		}
+		if contains(reservedLabels, parts[0]) || parts[0] == i.hostLabel {
+			return nil, fmt.Errorf("--metrics.const-label %s is a label of the exporter", parts[0])
+		}
+		if _, ok := i.constLabels[parts[0]]; ok {
+			return nil, fmt.Errorf("--metrics.const-label %s is set twice", parts[0])
+		}
+		i.constLabels[parts[0]] = parts[1]
+	}
+	return i, nil
+}
+
+// labels are the constant labels and the host label of a docker daemon in
+// hosts, the exporter hostname stands in until the daemon answers or without
+// daemon.
+func (i *metricsIdentity) labels(dockerHost string, hosts *hostLabels) map[string]string {
+	labels := make(map[string]string, len(i.constLabels)+1)
+	for name, value := range i.constLabels {
+		labels[name] = value
+	}
+	if i.hostLabel != "" {
+		host, ok := hosts.get(dockerHost)
+		if !ok {
+			host = i.hostname
+		}
+		labels[i.hostLabel] = host
+	}
+	return labels
+}
+
+// gatherer applies the identity to the metrics of g, with the host labels of
+// hosts.
+func (i *metricsIdentity) gatherer(g prometheus.Gatherer, hosts *hostLabels) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		if i.namespace != "docker" {
+			for _, family := range families {
+				if name := family.GetName(); strings.HasPrefix(name, "docker_") {
+					family.Name = proto.String(strings.TrimPrefix(i.namespace+"_"+strings.TrimPrefix(name, "docker_"), "_"))
+				}
+			}
+		}
+		if len(i.constLabels) == 0 && i.hostLabel == "" {
+			return families, err
+		}
+		for _, family := range families {
+			for _, metric := range family.Metric {
+				dockerHost := ""
+				for _, pair := range metric.Label {
+					if pair.GetName() == "docker_host" {
+						dockerHost = pair.GetValue()
+					}
+				}
+				relabelMetric(metric, i.labels(dockerHost, hosts))
+			}
+		}
+		return families, err
+	})
+}
+
+// resolveHost asks the docker daemon for the host label value in s.hosts: the
+// daemon host name, or the swarm node id for the node label. It is retried on
+// the next collect until the daemon answers.
+func (s *dockerScraper) resolveHost(ctx context.Context) {
+	if identity.hostLabel == "" {
+		return
+	}
+	if _, ok := s.hosts.get(s.name); ok {
+		return
+	}
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+	start := time.Now()
+	info, err := s.client.Info(ctx)
+	s.metrics.observeAPI(s.name, "info", start)
+	if err != nil {
+		log.WithField(logFieldDockerHost, s.name).WithError(err).Warn("Get docker info for the host label error")
+		return
+	}
+	host := info.Name
+	if identity.hostLabel == "node" && info.Swarm.NodeID != "" {
+		host = info.Swarm.NodeID
+	}
+	if host == "" {
+		host = identity.hostname
+	}
+
+	s.hosts.set(s.name, host)
+	log.WithFields(log.Fields{logFieldDockerHost: s.name, identity.hostLabel: host}).Info("Resolved the host label")
+}
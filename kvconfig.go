@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const kvConfigWaitTime = 5 * time.Minute
+
+var (
+	kvConfigLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_kv_config_last_reload_successful",
+		Help: "whether the last Consul KV configuration change was valid and applied."})
+	kvConfigLastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_kv_config_last_reload_success_timestamp_seconds",
+		Help: "timestamp of the last applied Consul KV configuration."})
+)
+
+// kvConfigWatcher applies the configuration under a Consul KV prefix with
+// blocking queries. Every key below the prefix is a configuration field
+// holding a YAML value, e.g. <prefix>/collect_interval = 1m, and nested keys
+// build maps, e.g. <prefix>/label_mappings/com.docker.compose.project =
+// compose_project. Invalid changes are logged and the last good configuration
+// stays in effect.
+type kvConfigWatcher struct {
+	consul *consulConnector
+	prefix string
+
+	mu sync.Mutex
+	// the configuration of the flags or the configuration file, keys override it
+	base runtimeConfig
+	// the last applied pairs
+	pairs api.KVPairs
+}
+
+func newKVConfigWatcher(consul *consulConnector, prefix string, base runtimeConfig) *kvConfigWatcher {
+	registry.MustRegister(kvConfigLastReloadSuccessful)
+	registry.MustRegister(kvConfigLastReloadSuccess)
+	// blocking queries outlast the request timeout, the watcher context bounds them
+	consul.timeout = 0
+	return &kvConfigWatcher{
+		consul: consul,
+		prefix: strings.TrimSuffix(prefix, "/") + "/",
+		base:   base,
+	}
+}
+
+// run watches the prefix until ctx is done.
+func (w *kvConfigWatcher) run(ctx context.Context) {
+	var index uint64
+	backoff := consulMinBackoff
+	for {
+		pairs, lastIndex, err := w.list(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"prefix": w.prefix, "retry_in": backoff}).WithError(err).Error("Watch Consul KV error")
+			w.consul.failover()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > consulMaxBackoff {
+				backoff = consulMaxBackoff
+			}
+			continue
+		}
+		backoff = consulMinBackoff
+
+		if lastIndex == index {
+			continue
+		}
+		// the index went backwards after a Consul restore
+		if lastIndex < index {
+			index = 0
+			continue
+		}
+		index = lastIndex
+		w.apply(pairs)
+	}
+}
+
+func (w *kvConfigWatcher) list(ctx context.Context, index uint64) (api.KVPairs, uint64, error) {
+	client, err := w.consul.client()
+	if err != nil {
+		return nil, 0, err
+	}
+	options := &api.QueryOptions{WaitIndex: index, WaitTime: kvConfigWaitTime}
+	pairs, meta, err := client.KV().List(w.prefix, options.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	return pairs, meta.LastIndex, nil
+}
+
+// apply parses and validates the pairs and puts them in effect.
+func (w *kvConfigWatcher) apply(pairs api.KVPairs) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	config, err := w.parse(pairs, w.base)
+	if err == nil {
+		err = setRuntimeConfig(config)
+	}
+	if err != nil {
+		kvConfigLastReloadSuccessful.Set(0)
+		log.WithField("prefix", w.prefix).WithError(err).Error("Invalid Consul KV configuration, keep the last good one")
+		return
+	}
+	w.pairs = pairs
+	kvConfigLastReloadSuccessful.Set(1)
+	kvConfigLastReloadSuccess.SetToCurrentTime()
+	log.WithFields(log.Fields{"prefix": w.prefix, "keys": len(pairs)}).Info("Apply Consul KV configuration")
+}
+
+// setBase replaces the configuration below the keys, e.g. on a reload of the
+// configuration file, and applies the last pairs on top of it.
+func (w *kvConfigWatcher) setBase(base runtimeConfig) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	config, err := w.parse(w.pairs, base)
+	if err != nil {
+		return fmt.Errorf("with Consul KV %s: %s", w.prefix, err)
+	}
+	if err := setRuntimeConfig(config); err != nil {
+		return err
+	}
+	w.base = base
+	return nil
+}
+
+// parse builds the configuration from the KV pairs on top of base.
+func (w *kvConfigWatcher) parse(pairs api.KVPairs, base runtimeConfig) (*runtimeConfig, error) {
+	tree := make(map[interface{}]interface{})
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, w.prefix)
+		// folders
+		if key == "" || strings.HasSuffix(key, "/") {
+			continue
+		}
+		var value interface{}
+		if err := yaml.Unmarshal(pair.Value, &value); err != nil {
+			return nil, fmt.Errorf("key %s: %s", pair.Key, err)
+		}
+
+		parts := strings.Split(key, "/")
+		node := tree
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[interface{}]interface{})
+			if !ok {
+				child = make(map[interface{}]interface{})
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = value
+	}
+
+	data, err := yaml.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	config := base
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
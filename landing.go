@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// build information, set with -ldflags "-X main.revision=$(git rev-parse HEAD)"
+var (
+	revision  = "unknown"
+	buildDate = "unknown"
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Prometheus Docker Exporter</title></head>
+<body>
+<h1>Prometheus Docker Exporter</h1>
+<p>Version {{ .Version }} (revision {{ .Revision }}, built {{ .BuildDate }}, {{ .GoVersion }})</p>
+<h2>Docker daemons</h2>
+<table>
+<tr><th align="left">docker host</th><th align="left">containers</th><th align="left">status</th></tr>
+{{ range .Daemons }}<tr><td>{{ .Name }}</td><td>{{ .Containers }}</td><td>{{ .Status }}</td></tr>
+{{ end }}</table>
+<h2>Configuration</h2>
+<ul>
+<li>collectors: {{ .Collectors }}</li>
+<li>collect interval: {{ .CollectInterval }}</li>
+{{ if .Include }}<li>include: {{ .Include }}</li>{{ end }}
+{{ if .Exclude }}<li>exclude: {{ .Exclude }}</li>{{ end }}
+</ul>
+<h2>Endpoints</h2>
+<ul>
+<li><a href="{{ .TelemetryPath }}">{{ .TelemetryPath }}</a> metrics</li>
+<li><a href="/health">/health</a> liveness</li>
+<li><a href="/ready">/ready</a> readiness</li>
+<li><a href="/sd">/sd</a> container service discovery</li>
+<li>/probe?target=tcp://host:2376&amp;module=default remote docker daemons</li>
+<li>POST /-/reload reloads the --config.file</li>
+<li><a href="/-/log-level">/-/log-level</a> log level, PUT a level to change it</li>
+{{ if .Pprof }}<li><a href="/debug/pprof/">/debug/pprof</a> profiling</li>{{ end }}
+</ul>
+</body>
+</html>
+`))
+
+type landingDaemon struct {
+	Name       string
+	Containers int
+	Status     string
+}
+
+// landingHandler serves the HTML page on /, any other unknown path is not found.
+func landingHandler(health *collectionHealth, version, telemetryPath string, pprof bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/" {
+			http.NotFound(writer, request)
+			return
+		}
+
+		config := getRuntimeConfig()
+
+		var daemons []landingDaemon
+		health.mu.Lock()
+		for _, scraper := range health.scrapers {
+			daemon := landingDaemon{Name: scraper.name, Status: "not collected yet"}
+			if result, ok := health.results[scraper.name]; ok {
+				daemon.Containers = result.containers
+				daemon.Status = "up"
+				if result.err != nil {
+					daemon.Status = result.err.Error()
+				}
+			}
+			daemons = append(daemons, daemon)
+		}
+		health.mu.Unlock()
+		sort.Slice(daemons, func(i, j int) bool { return daemons[i].Name < daemons[j].Name })
+
+		var buf bytes.Buffer
+		err := landingTemplate.Execute(&buf, map[string]interface{}{
+			"Version":         version,
+			"Revision":        revision,
+			"BuildDate":       buildDate,
+			"GoVersion":       runtime.Version(),
+			"Daemons":         daemons,
+			"Collectors":      strings.Join(config.enabledCollectors(), ", "),
+			"CollectInterval": config.CollectInterval,
+			"Include":         strings.Join(config.Include, ", "),
+			"Exclude":         strings.Join(config.Exclude, ", "),
+			"TelemetryPath":   telemetryPath,
+			"Pprof":           pprof,
+		})
+		if err != nil {
+			log.WithError(err).Error("Render landing page error")
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		writer.Write(buf.Bytes())
+	}
+}
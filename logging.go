@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// log field names shared by all log calls
+const (
+	logFieldDockerHost    = "docker_host"
+	logFieldContainerID   = "container_id"
+	logFieldContainerName = "container_name"
+	logFieldCollector     = "collector"
+	logFieldDuration      = "duration"
+)
+
+// setupLogging sets the level and the format, text (colored on a terminal),
+// logfmt or json.
+func setupLogging(level, format string) error {
+	parsed, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("--log.level: %s", err)
+	}
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "logfmt":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true, DisableColors: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("--log.format %q, use text, logfmt or json", format)
+	}
+	log.SetLevel(parsed)
+	return nil
+}
+
+// containerLog is the logger of a container of a docker daemon, the id is
+// shortened like in the container_id label.
+func containerLog(dockerHost, containerName, containerID string) *log.Entry {
+	if len(containerID) > 10 {
+		containerID = containerID[:10]
+	}
+	return log.WithFields(log.Fields{
+		logFieldDockerHost:    dockerHost,
+		logFieldContainerName: containerName,
+		logFieldContainerID:   containerID,
+	})
+}
+
+// logLevelHandler serves /-/log-level: GET returns the level, PUT or POST
+// with the level as body or ?level= changes it until the next restart.
+func logLevelHandler(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET", "HEAD":
+	case "PUT", "POST":
+		level := request.URL.Query().Get("level")
+		if level == "" {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, 64))
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+			level = strings.TrimSpace(string(body))
+		}
+		parsed, err := log.ParseLevel(level)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if parsed != log.GetLevel() {
+			log.SetLevel(parsed)
+			log.WithField("log_level", parsed.String()).Warn("Log level changed")
+		}
+	default:
+		writer.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(writer, log.GetLevel().String())
+}
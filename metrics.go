@@ -3,26 +3,68 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
-var flags = []cli.Flag{
+var flags = append([]cli.Flag{
+	cli.StringFlag{
+		EnvVar: "CONFIG_FILE",
+		Name:   "config.file",
+		Usage:  "YAML file with flags by name and the include, exclude, collectors and label_mappings settings, reloaded on SIGHUP or POST /-/reload. Command line and environment win over it",
+	},
 	cli.BoolFlag{
 		EnvVar: "DEBUG_MODE",
 		Name:   "debug",
-		Usage:  "enable app debug mode",
+		Usage:  "enable app debug mode, same as --log.level=debug",
+	},
+	cli.StringFlag{
+		EnvVar: "LOG_LEVEL",
+		Name:   "log.level",
+		Usage:  "log level: debug, info, warn, error, fatal or panic, changed at runtime on /-/log-level",
+		Value:  "warn",
+	},
+	cli.StringFlag{
+		EnvVar: "LOG_FORMAT",
+		Name:   "log.format",
+		Usage:  "log format: text, logfmt or json",
+		Value:  "text",
+	},
+	cli.StringFlag{
+		EnvVar: "REGISTRAR",
+		Name:   "registrar",
+		Usage:  "service discovery to register the exporter with: consul, file_sd or none",
+		Value:  "consul",
+	},
+	cli.DurationFlag{
+		EnvVar: "REGISTRAR_SYNC_INTERVAL",
+		Name:   "registrar-sync-interval",
+		Usage:  "how often to check that the service is still registered",
+		Value:  30 * time.Second,
+	},
+	cli.StringFlag{
+		EnvVar: "FILE_SD_PATH",
+		Name:   "file-sd.path",
+		Usage:  "file_sd registrar target file (.json, .yml or .yaml) to merge the exporter into, or a directory to write <service-id>.json to",
 	},
 	cli.StringFlag{
 		EnvVar: "CONSUL_ADDRESS",
 		Name:   "consul-address",
-		Usage:  "address of the Consul server",
+		Usage:  "address of the Consul server, a comma separated list to fail over between agents",
 		Value:  "127.0.0.1:8500",
 	},
 	cli.StringFlag{
@@ -36,6 +78,36 @@ var flags = []cli.Flag{
 		Name:   "consul-token",
 		Usage:  "Consul token is used to provide a per-request ACL token which overrides the agent's default token",
 	},
+	cli.StringFlag{
+		EnvVar: "CONSUL_HTTP_TOKEN_FILE",
+		Name:   "consul-token-file",
+		Usage:  "file with the Consul token, read again when it changes",
+	},
+	cli.StringFlag{
+		EnvVar: "CONSUL_CACERT",
+		Name:   "consul-tls-ca",
+		Usage:  "CA certificate to verify the Consul server, enables https",
+	},
+	cli.StringFlag{
+		EnvVar: "CONSUL_CLIENT_CERT",
+		Name:   "consul-tls-cert",
+		Usage:  "client certificate for Consul mTLS",
+	},
+	cli.StringFlag{
+		EnvVar: "CONSUL_CLIENT_KEY",
+		Name:   "consul-tls-key",
+		Usage:  "client key for Consul mTLS",
+	},
+	cli.StringFlag{
+		EnvVar: "CONSUL_TLS_SERVER_NAME",
+		Name:   "consul-tls-server-name",
+		Usage:  "server name to verify the Consul certificate against",
+	},
+	cli.BoolFlag{
+		EnvVar: "CONSUL_TLS_SKIP_VERIFY",
+		Name:   "consul-tls-skip-verify",
+		Usage:  "do not verify the Consul server certificate",
+	},
 	cli.StringFlag{
 		EnvVar: "CONSUL_USERNAME",
 		Name:   "consul-username",
@@ -60,7 +132,19 @@ var flags = []cli.Flag{
 	cli.StringFlag{
 		EnvVar: "CONSUL_SERVICE_IP",
 		Name:   "service-ip",
-		Usage:  "service ip register to Consul",
+		Usage:  "service ip register to Consul: an IP address, an interface name, a go-sockaddr template like {{ GetPrivateIP }} or default-route",
+		Value:  defaultRouteAddress,
+	},
+	cli.StringFlag{
+		EnvVar: "CONSUL_SERVICE_IP_FAMILY",
+		Name:   "service-ip-family",
+		Usage:  "address family of the service ip: ipv4, ipv6 or dual (ipv4 registered, both as address_ipv4/address_ipv6 meta)",
+		Value:  addressFamilyIPv4,
+	},
+	cli.BoolFlag{
+		EnvVar: "CONSUL_SERVICE_ALLOW_LOOPBACK",
+		Name:   "service-allow-loopback",
+		Usage:  "allow registering a loopback service ip",
 	},
 	cli.UintFlag{
 		EnvVar: "CONSUL_SERVICE_PORT",
@@ -71,7 +155,189 @@ var flags = []cli.Flag{
 	cli.StringSliceFlag{
 		EnvVar: "CONSUL_SERVICE_TAG",
 		Name:   "service-tags",
-		Usage:  "service tag register to Consul",
+		Usage:  "service tag register to Consul, a Go template on the host facts, e.g. docker-{{ .DockerVersion }}",
+	},
+	cli.StringSliceFlag{
+		EnvVar: "CONSUL_SERVICE_META",
+		Name:   "service-meta",
+		Usage:  "service meta key=value register to Consul, the value is a Go template on the host facts (.Version, .Hostname, .OS, .Kernel, .Arch, .DockerVersion, .SwarmNodeID)",
+	},
+	cli.StringFlag{
+		EnvVar: "CONSUL_KV_PREFIX",
+		Name:   "consul-kv-prefix",
+		Usage:  "Consul KV prefix of the runtime configuration (collect_interval, include, exclude, collectors, label_mappings), watched for changes",
+	},
+	cli.BoolFlag{
+		EnvVar: "REGISTRATOR",
+		Name:   "registrator",
+		Usage:  "register the containers labelled consul.service.name of the first docker daemon as Consul services",
+	},
+	cli.StringFlag{
+		EnvVar: "REGISTRATOR_ADDRESS",
+		Name:   "registrator.address",
+		Usage:  "address of the container services: container (container ip and port) or host (published host port)",
+		Value:  "container",
+	},
+	cli.DurationFlag{
+		EnvVar: "REGISTRATOR_CHECK_TTL",
+		Name:   "registrator.check-ttl",
+		Usage:  "TTL of the checks mirroring the docker HEALTHCHECK, refreshed every --registrar-sync-interval",
+		Value:  90 * time.Second,
+	},
+	cli.StringFlag{
+		EnvVar: "CONSUL_CHECK",
+		Name:   "consul-check",
+		Usage:  "Consul check of the service: http polls /ready, ttl is updated with the collection health",
+		Value:  "http",
+	},
+	cli.DurationFlag{
+		EnvVar: "CONSUL_CHECK_INTERVAL",
+		Name:   "consul-check-interval",
+		Usage:  "interval of the Consul http check",
+		Value:  30 * time.Second,
+	},
+	cli.DurationFlag{
+		EnvVar: "CONSUL_CHECK_TIMEOUT",
+		Name:   "consul-check-timeout",
+		Usage:  "timeout of the Consul http check",
+		Value:  3 * time.Second,
+	},
+	cli.DurationFlag{
+		EnvVar: "CONSUL_CHECK_TTL",
+		Name:   "consul-check-ttl",
+		Usage:  "ttl of the Consul ttl check, must be longer than the collect interval",
+		Value:  3 * time.Minute,
+	},
+	cli.DurationFlag{
+		EnvVar: "CONSUL_DEREGISTER_CRITICAL_AFTER",
+		Name:   "consul-deregister-critical-after",
+		Usage:  "Consul deregisters the service after its check is critical for this long, 0 to disable",
+		Value:  time.Minute,
+	},
+	cli.StringFlag{
+		EnvVar: "DOCKER_HOST",
+		Name:   "docker-host",
+		Usage:  "docker daemon address, defaults to the docker CLI context, a rootless socket in $XDG_RUNTIME_DIR or unix:///var/run/docker.sock",
+	},
+	cli.StringFlag{
+		EnvVar: "DOCKER_CONTEXT",
+		Name:   "docker-context",
+		Usage:  "docker CLI context to connect to, defaults to the currentContext of ~/.docker/config.json",
+	},
+	cli.StringFlag{
+		EnvVar: "DOCKER_CERT_PATH",
+		Name:   "docker-cert-path",
+		Usage:  "directory with the ca.pem, cert.pem and key.pem of the docker daemon",
+	},
+	cli.StringFlag{
+		EnvVar: "DOCKER_TLS_CA",
+		Name:   "docker-tls-ca",
+		Usage:  "CA certificate of the docker daemon",
+	},
+	cli.StringFlag{
+		EnvVar: "DOCKER_TLS_CERT",
+		Name:   "docker-tls-cert",
+		Usage:  "client certificate for the docker daemon",
+	},
+	cli.StringFlag{
+		EnvVar: "DOCKER_TLS_KEY",
+		Name:   "docker-tls-key",
+		Usage:  "client key for the docker daemon",
+	},
+	cli.BoolFlag{
+		EnvVar: "DOCKER_TLS_VERIFY",
+		Name:   "docker-tls-verify",
+		Usage:  "verify the docker daemon certificate",
+	},
+	cli.StringFlag{
+		EnvVar: "DOCKER_API_VERSION",
+		Name:   "docker-api-version",
+		Usage:  "docker api version, negotiated with the daemon when not set",
+	},
+	cli.DurationFlag{
+		EnvVar: "DOCKER_TIMEOUT",
+		Name:   "docker-timeout",
+		Usage:  "timeout of a docker api request",
+		Value:  30 * time.Second,
+	},
+	cli.DurationFlag{
+		EnvVar: "COLLECT_INTERVAL",
+		Name:   "collect-interval",
+		Usage:  "interval between two collections of the docker daemons",
+		Value:  time.Minute,
+	},
+	cli.StringSliceFlag{
+		EnvVar: "DOCKER_ENDPOINTS",
+		Name:   "docker-endpoint",
+		Usage:  "docker daemon to collect from, e.g. tcp://host:2376?name=build-01&tls-cert-path=/certs&tls-verify=true&api-version=1.37, repeat for multiple daemons. Defaults to the --docker-* flags",
+	},
+	cli.StringFlag{
+		EnvVar: "SD_ADDRESS",
+		Name:   "sd.address",
+		Usage:  "default address of the /sd targets: container (container ip and port) or host (published host port)",
+		Value:  "container",
+	},
+	cli.DurationFlag{
+		EnvVar: "PROXY_TIMEOUT",
+		Name:   "proxy.timeout",
+		Usage:  "timeout of the container metrics scraped by /containers/{name}/metrics",
+		Value:  10 * time.Second,
+	},
+	cli.Int64Flag{
+		EnvVar: "PROXY_MAX_BYTES",
+		Name:   "proxy.max-bytes",
+		Usage:  "largest container metrics response accepted by /containers/{name}/metrics",
+		Value:  16 << 20,
+	},
+	cli.StringFlag{
+		EnvVar: "PROBE_CONFIG",
+		Name:   "probe.config",
+		Usage:  "YAML file with the named modules of /probe, e.g. the TLS credentials of remote docker daemons",
+	},
+	cli.StringFlag{
+		EnvVar: "PROCFS_PATH",
+		Name:   "procfs",
+		Usage:  "host proc filesystem mount point, used to read container network namespaces",
+		Value:  "/proc",
+	},
+	cli.StringFlag{
+		EnvVar: "SYSFS_PATH",
+		Name:   "sysfs",
+		Usage:  "host sys filesystem mount point, used to resolve host veth interfaces",
+		Value:  "/sys",
+	},
+	cli.StringFlag{
+		EnvVar: "METRICS_NAMESPACE",
+		Name:   "metrics.namespace",
+		Usage:  "prefix of the exporter metrics in place of docker, e.g. acme for acme_container_cpu_stats_all, empty for none",
+		Value:  "docker",
+	},
+	cli.StringSliceFlag{
+		EnvVar: "METRICS_CONST_LABELS",
+		Name:   "metrics.const-label",
+		Usage:  "name=value label added to every series, e.g. datacenter=fra1, repeat for multiple labels",
+	},
+	cli.StringFlag{
+		EnvVar: "METRICS_HOST_LABEL",
+		Name:   "metrics.host-label",
+		Usage:  "label every series with the docker daemon host: host (daemon host name), node (swarm node id, the host name outside a swarm) or none",
+		Value:  "none",
+	},
+	cli.StringFlag{
+		EnvVar: "WEB_TELEMETRY_PATH",
+		Name:   "web.telemetry-path",
+		Usage:  "path of the metrics, / serves a landing page otherwise",
+		Value:  "/metrics",
+	},
+	cli.StringFlag{
+		EnvVar: "WEB_CONFIG_FILE",
+		Name:   "web.config.file",
+		Usage:  "web config file with TLS (tls_server_config) and basic auth (basic_auth_users) of the HTTP server",
+	},
+	cli.BoolFlag{
+		EnvVar: "WEB_ENABLE_PPROF",
+		Name:   "web.enable-pprof",
+		Usage:  "serve the Go profiles on /debug/pprof/, they expose heap and goroutine details",
 	},
 	cli.StringFlag{
 		EnvVar: "SERVER_ADDR",
@@ -79,101 +345,510 @@ var flags = []cli.Flag{
 		Usage:  "server address",
 		Value:  ":8000",
 	},
-}
+	cli.DurationFlag{
+		EnvVar: "SHUTDOWN_TIMEOUT",
+		Name:   "shutdown-timeout",
+		Usage:  "time to wait for in-flight requests on shutdown",
+		Value:  10 * time.Second,
+	},
+}, collectorFlags()...)
 
 func metricServer(c *cli.Context) error {
-	// docker client
-	client, err := client.NewClientWithOpts(client.FromEnv)
+	baseConfig := runtimeConfig{CollectInterval: c.Duration("collect-interval")}
+	if fileConfig != nil {
+		baseConfig = fileConfig.runtimeConfig()
+	}
+	if err := setRuntimeConfig(&baseConfig); err != nil {
+		log.WithError(err).Error("Invalid configuration")
+		return err
+	}
+	// Consul KV keys override the runtime configuration, also on a reload of the file
+	var kvConfig *kvConfigWatcher
+	if prefix := c.String("consul-kv-prefix"); prefix != "" {
+		kvConfig = newKVConfigWatcher(newConsulConnector(c), prefix, baseConfig)
+		if fileConfig != nil {
+			fileConfig.apply = kvConfig.setBase
+		}
+	}
+
+	// docker targets, the --docker-* flags when none is configured
+	var targets []dockerTarget
+	for _, endpoint := range c.StringSlice("docker-endpoint") {
+		target, err := parseDockerTarget(endpoint)
+		if err != nil {
+			log.WithError(err).Error("Invalid docker endpoint")
+			return err
+		}
+		if target.Timeout == 0 {
+			target.Timeout = c.Duration("docker-timeout")
+		}
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		target, err := defaultDockerTarget(c)
+		if err != nil {
+			log.WithError(err).Error("Find docker daemon error")
+			return err
+		}
+		targets = append(targets, target)
+	}
+
+	var scrapers []*dockerScraper
+	for _, target := range targets {
+		scraper, err := newDockerScraper(target, metrics)
+		if err != nil {
+			log.WithField(logFieldDockerHost, target.Host).WithError(err).Error("Init docker client error")
+			return err
+		}
+		scrapers = append(scrapers, scraper)
+	}
+
+	web := new(webConfig)
+	if path := c.String("web.config.file"); path != "" {
+		var err error
+		web, err = loadWebConfig(path)
+		if err != nil {
+			log.WithError(err).Error("Load web config error")
+			return err
+		}
+	}
+
+	// service meta describes the first docker daemon
+	gatherFacts := func() serviceFacts {
+		return gatherServiceFacts(scrapers[0].client, c.App.Version)
+	}
+	facts := gatherFacts()
+	var err error
+	serviceRegistrar, err = newRegistrar(c, facts, gatherFacts, web.TLSServerConfig)
 	if err != nil {
-		log.Error("", err)
+		log.WithError(err).Error("Init registrar error")
 		return err
 	}
 
-	// health check
-	http.HandleFunc("/health", func(writer http.ResponseWriter, request *http.Request) {
-		writer.Header().Set("Content-Type", "text/plain")
-		writer.Header().Set("Cache-Control", "no-cache,no-store")
-		writer.Header().Set("Server", "prometheus")
-		writer.Write([]byte("ok\n"))
-	})
+	var containerRegistrator *containerRegistrator
+	if c.Bool("registrator") {
+		containerRegistrator, err = newRegistrator(c, scrapers[0], facts)
+		if err != nil {
+			log.WithError(err).Error("Init registrator error")
+			return err
+		}
+	}
 
-	http.Handle("/", handler)
-	http.Handle("/metrics", handler)
+	health := newCollectionHealth(scrapers)
+	for _, scraper := range scrapers {
+		scraper.onCollect = func(s *dockerScraper, result scrapeResult) {
+			health.update(s.name, result)
+			if reporter, ok := serviceRegistrar.(healthReporter); ok {
+				reporter.reportHealth(health.status())
+			}
+		}
+	}
 
-	go func() {
-		err = http.ListenAndServe(c.String("server-addr"), nil)
+	if path := c.String("probe.config"); path != "" {
+		modules, err := loadProbeConfig(path)
 		if err != nil {
-			log.Panic("HTTP Server Listen failed.")
+			log.WithError(err).Error("Load probe config error")
+			return err
+		}
+		probeModules = modules
+	}
+
+	// not the DefaultServeMux, net/http/pprof registers its handlers there
+	mux := http.NewServeMux()
+	// health check, /health for liveness and /ready for readiness
+	mux.HandleFunc("/health", health.handler(false))
+	mux.HandleFunc("/ready", health.handler(true))
+
+	telemetryPath := c.String("web.telemetry-path")
+	if !strings.HasPrefix(telemetryPath, "/") {
+		err = fmt.Errorf("--web.telemetry-path %q must start with /", telemetryPath)
+		log.WithError(err).Error("Invalid configuration")
+		return err
+	}
+	mux.HandleFunc(telemetryPath, metricsHandler(scrapers))
+	if telemetryPath != "/" {
+		mux.HandleFunc("/", landingHandler(health, c.App.Version, telemetryPath, c.Bool("web.enable-pprof")))
+	}
+	mux.HandleFunc("/-/log-level", logLevelHandler)
+	mux.HandleFunc("/-/reload", reloadHandler)
+	mux.HandleFunc("/probe", probeHandler)
+	sd := newContainerSD(c, scrapers, facts)
+	mux.HandleFunc("/sd", sd.handler)
+	mux.HandleFunc("/containers/", newMetricsProxy(sd, c.Duration("proxy.timeout"), c.Int64("proxy.max-bytes")).handler)
+
+	if c.Bool("web.enable-pprof") {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	server := &http.Server{Addr: c.String("server-addr"), Handler: web.handler(mux)}
+	serverErr := make(chan error, 1)
+	go func() {
+		var err error
+		if web.TLSServerConfig != nil {
+			server.TLSConfig = web.serverTLSConfig()
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("HTTP server listen error")
+			serverErr <- err
+		}
+	}()
+
+	registrarCtx, registrarCancel := context.WithCancel(context.Background())
+	registrarDone := make(chan struct{})
+	go func() {
+		defer close(registrarDone)
+		serviceRegistrar.run(registrarCtx)
+	}()
+	kvConfigDone := make(chan struct{})
+	go func() {
+		defer close(kvConfigDone)
+		if kvConfig != nil {
+			kvConfig.run(registrarCtx)
+		}
+	}()
+	registratorDone := make(chan struct{})
+	go func() {
+		defer close(registratorDone)
+		if containerRegistrator != nil {
+			containerRegistrator.run(registrarCtx)
 		}
 	}()
 
-	for true {
-		log.Info("Get Containers stats.")
-		containers, err := client.ContainerList(context.Background(), types.ContainerListOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, scraper := range scrapers {
+		wg.Add(1)
+		go func(scraper *dockerScraper) {
+			defer wg.Done()
+			scraper.run(ctx)
+		}(scraper)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if fileConfig != nil {
+					fileConfig.reload()
+				}
+				continue
+			}
+			log.WithField("signal", sig.String()).Warn("Shutting down")
+			break wait
+		case err = <-serverErr:
+			break wait
+		}
+	}
+
+	// leave service discovery first so no more scrapes are routed here
+	registrarCancel()
+	<-registrarDone
+	serviceRegistrar.deregister()
+	<-registratorDone
+	<-kvConfigDone
+	if containerRegistrator != nil {
+		containerRegistrator.deregister()
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), c.Duration("shutdown-timeout"))
+	defer shutdownCancel()
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil {
+		log.WithError(shutdownErr).Error("HTTP server shutdown error")
+	}
+
+	cancel()
+	wg.Wait()
+	log.Warn("Shutdown complete")
+
+	return err
+}
+
+func containerToMetrics(ctx context.Context, m *dockerMetrics, dockerHost string, client *client.Client, local bool, container types.Container, config *runtimeConfig, results *collectorResults) error {
+	name := container.Names[0][1:]
+	shortID := container.ID[:10]
+	logger := containerLog(dockerHost, name, shortID)
+	logger.Debug("Collect container")
+	// probes collect into their own registry without the label info
+	if m == metrics {
+		containerLabels.set(dockerHost, name, shortID, container.Labels)
+	}
+
+	if config.anyCollectorEnabled(statsCollectors) {
+		start := time.Now()
+		err := statsToMetrics(ctx, m, dockerHost, client, container, config)
+		results.observe(logger, "stats", start, err)
 		if err != nil {
-			log.Error("Get container list error: ", err)
 			return err
 		}
-		scrapeNumber.Inc()
-		statsNumber.Set(0)
-		for _, container := range containers {
-			go containerToMetrics(client, container)
-		}
-		time.Sleep(time.Minute)
+	}
+	// the pid of a remote daemon is not in the procfs of the exporter
+	procfs := local && config.anyCollectorEnabled(procfsCollectors)
+	if !procfs && !config.anyCollectorEnabled(inspectCollectors) {
+		return nil
+	}
+
+	start := time.Now()
+	containerJSON, err := client.ContainerInspect(ctx, container.ID)
+	m.observeAPI(dockerHost, "inspect", start)
+	if err != nil {
+		logger.WithError(err).Error("Inspect container error")
+		m.statsErrors.WithLabelValues(dockerHost, name, shortID, statsErrorReason(ctx, "inspect")).Inc()
+		return err
+	}
+	if procfs && config.collectorEnabled("sockets") {
+		start := time.Now()
+		results.observe(logger, "sockets", start, socketsToMetrics(m, dockerHost, name, shortID, containerJSON))
+	}
+	if procfs && config.collectorEnabled("netinfo") {
+		start := time.Now()
+		results.observe(logger, "netinfo", start, networkInfoToMetrics(m, dockerHost, name, shortID, containerJSON))
+	}
+	if config.collectorEnabled("state") {
+		start := time.Now()
+		stateToMetrics(m, dockerHost, name, shortID, containerJSON)
+		results.observe(logger, "state", start, nil)
+	}
+	if config.collectorEnabled("health") {
+		start := time.Now()
+		healthToMetrics(m, dockerHost, name, shortID, containerJSON)
+		results.observe(logger, "health", start, nil)
 	}
 
 	return nil
 }
 
-func containerToMetrics(client *client.Client, container types.Container) error {
+// collectors served by one container stats or inspect request, the procfs
+// collectors read the network namespace of the inspected pid of a local daemon
+var (
+	statsCollectors   = []string{"cpu", "memory", "network", "blkio", "pids"}
+	inspectCollectors = []string{"state", "health"}
+	procfsCollectors  = []string{"sockets", "netinfo"}
+)
+
+// containerStates are the values of the state label of docker_container_state,
+// the containers in runningStates are collected, the others only have a state
+var (
+	containerStates = []string{"created", "running", "paused", "restarting", "removing", "exited", "dead"}
+	runningStates   = []string{"running", "paused", "restarting"}
+)
+
+// stoppedContainerToMetrics exports the state of a container that is not
+// running, its restart count and start time stay at the last values.
+func stoppedContainerToMetrics(m *dockerMetrics, dockerHost string, container types.Container) {
 	name := container.Names[0][1:]
 	shortID := container.ID[:10]
-	log.Infof("Container Name %v (ID: %s)", name, shortID)
-	resp, err := client.ContainerStats(context.Background(), container.ID, false)
+	containerLog(dockerHost, name, shortID).WithField("state", container.State).Debug("Collect stopped container")
+	if m == metrics {
+		containerLabels.set(dockerHost, name, shortID, container.Labels)
+	}
+	setContainerState(m, dockerHost, name, shortID, container.State)
+}
+
+// setContainerState sets docker_container_state to 1 for state and 0 for the others.
+func setContainerState(m *dockerMetrics, dockerHost, containerName, shortID, current string) {
+	for _, state := range containerStates {
+		value := 0.0
+		if current == state {
+			value = 1
+		}
+		m.state.WithLabelValues(dockerHost, containerName, shortID, state).Set(value)
+	}
+}
+
+// stateToMetrics exports the state, restart count and start time of the container.
+func stateToMetrics(m *dockerMetrics, dockerHost, containerName, shortID string, containerJSON types.ContainerJSON) {
+	if containerJSON.ContainerJSONBase == nil || containerJSON.State == nil {
+		return
+	}
+	setContainerState(m, dockerHost, containerName, shortID, containerJSON.State.Status)
+	m.restartCount.WithLabelValues(dockerHost, containerName, shortID).Set(float64(containerJSON.RestartCount))
+	if startedAt, err := time.Parse(time.RFC3339Nano, containerJSON.State.StartedAt); err == nil {
+		m.startedAt.WithLabelValues(dockerHost, containerName, shortID).Set(float64(startedAt.UnixNano()) / 1e9)
+	}
+}
+
+// healthToMetrics exports the HEALTHCHECK status of the container, if it has one.
+func healthToMetrics(m *dockerMetrics, dockerHost, containerName, shortID string, containerJSON types.ContainerJSON) {
+	if containerJSON.ContainerJSONBase == nil || containerJSON.State == nil || containerJSON.State.Health == nil {
+		return
+	}
+	health := containerJSON.State.Health
+	for _, status := range []string{types.Starting, types.Healthy, types.Unhealthy} {
+		value := 0.0
+		if health.Status == status {
+			value = 1
+		}
+		m.healthStatus.WithLabelValues(dockerHost, containerName, shortID, status).Set(value)
+	}
+	m.healthFailing.WithLabelValues(dockerHost, containerName, shortID).Set(float64(health.FailingStreak))
+}
+
+// statsToMetrics exports the cpu, memory, network, blkio and pids stats of the container.
+func statsToMetrics(ctx context.Context, m *dockerMetrics, dockerHost string, client *client.Client, container types.Container, config *runtimeConfig) error {
+	name := container.Names[0][1:]
+	shortID := container.ID[:10]
+	logger := containerLog(dockerHost, name, shortID).WithField(logFieldCollector, "stats")
+	start := time.Now()
+	resp, err := client.ContainerStats(ctx, container.ID, false)
 	if err != nil {
-		log.Errorf("Container Name %v (ID: %s) get container stats error: %s", name, shortID, err)
-		return nil
+		m.observeAPI(dockerHost, "stats", start)
+		logger.WithError(err).Error("Get container stats error")
+		m.statsErrors.WithLabelValues(dockerHost, name, shortID, statsErrorReason(ctx, "stats_request")).Inc()
+		return err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	m.observeAPI(dockerHost, "stats", start)
 	if err != nil {
-		log.Errorf("Container Name: %v (ID: %s) read container stats data error: ", name, shortID, err)
-		return nil
+		logger.WithError(err).Error("Read container stats error")
+		m.statsErrors.WithLabelValues(dockerHost, name, shortID, statsErrorReason(ctx, "stats_read")).Inc()
+		return err
 	}
 
 	var containerStats types.StatsJSON
 	if err = json.Unmarshal(body, &containerStats); err != nil {
-		log.Errorf("Container Name: %v (ID: %s) format container stats data to json error: %s", name, shortID, err)
-		return nil
+		logger.WithError(err).Error("Decode container stats error")
+		m.statsErrors.WithLabelValues(dockerHost, name, shortID, "stats_decode").Inc()
+		return err
 	}
 	if container.ID != containerStats.ID {
-		log.Error("Container ID Inconsistent.")
-		return nil
+		logger.WithField("stats_container_id", containerStats.ID).Error("Container stats of another container")
+		m.statsErrors.WithLabelValues(dockerHost, name, shortID, "id_mismatch").Inc()
+		return fmt.Errorf("container id inconsistent: %s != %s", container.ID, containerStats.ID)
 	}
 
-	statsNumber.Inc()
+	m.statsNumber.WithLabelValues(dockerHost).Inc()
 	containerName := containerStats.Name[1:]
 
-	memoryLimit.WithLabelValues(containerName, shortID).Set(float64(containerStats.MemoryStats.Limit))
-	memoryUsage.WithLabelValues(containerName, shortID).Set(float64(containerStats.MemoryStats.Usage))
-	rss, ok := containerStats.MemoryStats.Stats["rss"]
-	if ok {
-		memoryRss.WithLabelValues(containerName, shortID).Set(float64(rss))
-	} else {
-		log.Warnf("Container Name %v (ID: %s) stats not rss field", name, shortID)
+	if config.collectorEnabled("memory") {
+		m.memoryLimit.WithLabelValues(dockerHost, containerName, shortID).Set(float64(containerStats.MemoryStats.Limit))
+		m.memoryUsage.WithLabelValues(dockerHost, containerName, shortID).Set(float64(containerStats.MemoryStats.Usage))
+		rss, ok := containerStats.MemoryStats.Stats["rss"]
+		if ok {
+			m.memoryRss.WithLabelValues(dockerHost, containerName, shortID).Set(float64(rss))
+		} else {
+			logger.Warn("Container memory stats have no rss")
+		}
 	}
 
-	cpuUser.WithLabelValues(containerName, shortID).Set(float64(containerStats.CPUStats.CPUUsage.UsageInUsermode))
-	cpuKernel.WithLabelValues(containerName, shortID).Set(float64(containerStats.CPUStats.CPUUsage.UsageInKernelmode))
-	cpuAll.WithLabelValues(containerName, shortID).Set(float64(containerStats.CPUStats.CPUUsage.TotalUsage))
-	cpuSystem.WithLabelValues(containerName, shortID).Set(float64(containerStats.CPUStats.SystemUsage))
+	if config.collectorEnabled("cpu") {
+		m.cpuUser.WithLabelValues(dockerHost, containerName, shortID).Set(float64(containerStats.CPUStats.CPUUsage.UsageInUsermode))
+		m.cpuKernel.WithLabelValues(dockerHost, containerName, shortID).Set(float64(containerStats.CPUStats.CPUUsage.UsageInKernelmode))
+		m.cpuAll.WithLabelValues(dockerHost, containerName, shortID).Set(float64(containerStats.CPUStats.CPUUsage.TotalUsage))
+		m.cpuSystem.WithLabelValues(dockerHost, containerName, shortID).Set(float64(containerStats.CPUStats.SystemUsage))
+	}
 
-	for netName, network := range containerStats.Networks {
-		rxBytes.WithLabelValues(containerName, shortID, netName).Set(float64(network.RxBytes))
-		rxPackets.WithLabelValues(containerName, shortID, netName).Set(float64(network.RxPackets))
-		txBytes.WithLabelValues(containerName, shortID, netName).Set(float64(network.TxBytes))
-		txPackets.WithLabelValues(containerName, shortID, netName).Set(float64(network.TxPackets))
+	if config.collectorEnabled("network") {
+		for netName, network := range containerStats.Networks {
+			m.rxBytes.WithLabelValues(dockerHost, containerName, shortID, netName).Set(float64(network.RxBytes))
+			m.rxPackets.WithLabelValues(dockerHost, containerName, shortID, netName).Set(float64(network.RxPackets))
+			m.txBytes.WithLabelValues(dockerHost, containerName, shortID, netName).Set(float64(network.TxBytes))
+			m.txPackets.WithLabelValues(dockerHost, containerName, shortID, netName).Set(float64(network.TxPackets))
+		}
 	}
 
+	if config.collectorEnabled("blkio") {
+		for _, entry := range containerStats.BlkioStats.IoServiceBytesRecursive {
+			device := fmt.Sprintf("%d:%d", entry.Major, entry.Minor)
+			m.blkioBytes.WithLabelValues(dockerHost, containerName, shortID, device, strings.ToLower(entry.Op)).Set(float64(entry.Value))
+		}
+		for _, entry := range containerStats.BlkioStats.IoServicedRecursive {
+			device := fmt.Sprintf("%d:%d", entry.Major, entry.Minor)
+			m.blkioOps.WithLabelValues(dockerHost, containerName, shortID, device, strings.ToLower(entry.Op)).Set(float64(entry.Value))
+		}
+	}
+
+	if config.collectorEnabled("pids") {
+		m.pidsCurrent.WithLabelValues(dockerHost, containerName, shortID).Set(float64(containerStats.PidsStats.Current))
+		if containerStats.PidsStats.Limit > 0 {
+			m.pidsLimit.WithLabelValues(dockerHost, containerName, shortID).Set(float64(containerStats.PidsStats.Limit))
+		}
+	}
+
+	return nil
+}
+
+// statsErrorReason is reason, or timeout when the request ran out of time.
+func statsErrorReason(ctx context.Context, reason string) string {
+	if ctx.Err() == context.DeadlineExceeded {
+		return "timeout"
+	}
+	return reason
+}
+
+// socketsToMetrics exports the tcp socket states of the container network namespace.
+func socketsToMetrics(m *dockerMetrics, dockerHost, containerName, shortID string, containerJSON types.ContainerJSON) error {
+	if containerJSON.State == nil || containerJSON.State.Pid == 0 {
+		return nil
+	}
+	stats, err := readSocketStats(containerJSON.State.Pid)
+	if err != nil {
+		containerLog(dockerHost, containerName, shortID).WithField(logFieldCollector, "sockets").WithError(err).Debug("Read socket stats error")
+		return err
+	}
+
+	for state, count := range stats.connections {
+		m.tcpConnections.WithLabelValues(dockerHost, containerName, shortID, state).Set(float64(count))
+	}
+	m.tcpListen.WithLabelValues(dockerHost, containerName, shortID).Set(float64(stats.listen))
+	for protocol, fields := range stats.sockstat {
+		for field, value := range fields {
+			m.sockstat.WithLabelValues(dockerHost, containerName, shortID, protocol, field).Set(float64(value))
+		}
+	}
+	return nil
+}
+
+// networkInfoToMetrics maps container interfaces to their host veth peer and docker network.
+func networkInfoToMetrics(m *dockerMetrics, dockerHost, containerName, shortID string, containerJSON types.ContainerJSON) error {
+	if containerJSON.State == nil || containerJSON.State.Pid == 0 {
+		return nil
+	}
+	interfaces, err := readContainerInterfaces(containerJSON.State.Pid)
+	if err != nil {
+		containerLog(dockerHost, containerName, shortID).WithField(logFieldCollector, "netinfo").WithError(err).Debug("Read network interfaces error")
+		return err
+	}
+	hostInterfaces, err := readHostInterfaces()
+	if err != nil {
+		log.WithField(logFieldCollector, "netinfo").WithError(err).Debug("Read host network interfaces error")
+		return err
+	}
+
+	current := make(map[string]bool)
+	for _, inter := range interfaces {
+		var networkName, ipAddress string
+		if containerJSON.NetworkSettings != nil {
+			for name, endpoint := range containerJSON.NetworkSettings.Networks {
+				if endpoint == nil || !strings.EqualFold(endpoint.MacAddress, inter.mac) {
+					continue
+				}
+				networkName = name
+				ipAddress = endpoint.IPAddress
+				if ipAddress == "" {
+					ipAddress = endpoint.GlobalIPv6Address
+				}
+			}
+		}
+		// host network and macvlan interfaces have no peer in the host namespace
+		hostInterface := hostInterfaces[inter.iflink]
+		m.networkInfo.WithLabelValues(dockerHost, containerName, shortID, inter.name, hostInterface, networkName, ipAddress).Set(1)
+		current[strings.Join([]string{inter.name, hostInterface, networkName, ipAddress}, "\n")] = true
+	}
+	// the ip address and veth peer of a restarted or reconnected container change
+	deleteSeries(m.networkInfo, func(labels prometheus.Labels) bool {
+		return labels["docker_host"] == dockerHost && labels["container_id"] == shortID &&
+			!current[strings.Join([]string{labels["interface"], labels["host_interface"], labels["network"], labels["ip_address"]}, "\n")]
+	})
 	return nil
 }
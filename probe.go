@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// probeConfig is the --probe.config file. Modules name the docker connection
+// settings, mostly the TLS credentials, a probe uses for its target.
+type probeConfig struct {
+	Modules map[string]probeModule `yaml:"modules"`
+}
+
+type probeModule struct {
+	APIVersion string `yaml:"api_version"`
+	// directory with ca.pem, cert.pem and key.pem like DOCKER_CERT_PATH
+	TLSCertPath string        `yaml:"tls_cert_path"`
+	TLSCACert   string        `yaml:"tls_ca"`
+	TLSCert     string        `yaml:"tls_cert"`
+	TLSKey      string        `yaml:"tls_key"`
+	TLSVerify   bool          `yaml:"tls_verify"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+const (
+	defaultProbeTimeout = 30 * time.Second
+	// bounds of the docker clients kept for probe targets
+	maxProbeClients        = 256
+	probeClientIdleTimeout = 10 * time.Minute
+)
+
+var (
+	probeModules = map[string]probeModule{"default": {}}
+
+	// docker clients reused across probes, keyed by module and target
+	probeClientsMu sync.Mutex
+	probeClients   = make(map[string]*probeTarget)
+)
+
+// probeTarget is the docker client of a probe target reused across probes.
+type probeTarget struct {
+	client *client.Client
+
+	// serializes the api version negotiation of concurrent probes
+	mu        sync.Mutex
+	negotiate bool
+
+	// guarded by probeClientsMu
+	probes   int
+	lastUsed time.Time
+	evicted  bool
+}
+
+// loadProbeConfig reads the probe modules from path.
+func loadProbeConfig(path string) (map[string]probeModule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config probeConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("parse probe config %s: %s", path, err)
+	}
+	if len(config.Modules) == 0 {
+		return nil, fmt.Errorf("probe config %s has no modules", path)
+	}
+	return config.Modules, nil
+}
+
+// dockerTarget returns the connection settings of module for host.
+func (module probeModule) dockerTarget(host string) dockerTarget {
+	target := dockerTarget{
+		Name:       host,
+		Host:       host,
+		APIVersion: module.APIVersion,
+		TLSCACert:  module.TLSCACert,
+		TLSCert:    module.TLSCert,
+		TLSKey:     module.TLSKey,
+		TLSVerify:  module.TLSVerify,
+		Timeout:    module.Timeout,
+	}
+	if module.TLSCertPath != "" {
+		if target.TLSCACert == "" {
+			target.TLSCACert = filepath.Join(module.TLSCertPath, "ca.pem")
+		}
+		if target.TLSCert == "" {
+			target.TLSCert = filepath.Join(module.TLSCertPath, "cert.pem")
+		}
+		if target.TLSKey == "" {
+			target.TLSKey = filepath.Join(module.TLSCertPath, "key.pem")
+		}
+	}
+	return target
+}
+
+// probeClient creates or reuses the docker client of target, the api version
+// is negotiated by the probes. Clients idle for probeClientIdleTimeout are
+// closed, the least recently used one makes room beyond maxProbeClients.
+// The probe releases the client when done.
+func probeClient(moduleName string, target dockerTarget) (*probeTarget, error) {
+	key := moduleName + "|" + target.Host
+	now := time.Now()
+
+	probeClientsMu.Lock()
+	defer probeClientsMu.Unlock()
+	for k, t := range probeClients {
+		if t.probes == 0 && now.Sub(t.lastUsed) > probeClientIdleTimeout {
+			evictProbeClient(k, t)
+		}
+	}
+	t, ok := probeClients[key]
+	if !ok {
+		cli, err := newDockerClient(target)
+		if err != nil {
+			return nil, err
+		}
+		if len(probeClients) >= maxProbeClients {
+			var oldestKey string
+			var oldest *probeTarget
+			for k, t := range probeClients {
+				if oldest == nil || t.lastUsed.Before(oldest.lastUsed) {
+					oldestKey, oldest = k, t
+				}
+			}
+			evictProbeClient(oldestKey, oldest)
+		}
+		t = &probeTarget{client: cli, negotiate: target.APIVersion == ""}
+		probeClients[key] = t
+	}
+	t.probes++
+	t.lastUsed = now
+	return t, nil
+}
+
+// evictProbeClient removes the client from the cache, a client in use is
+// closed by the last probe releasing it.
+func evictProbeClient(key string, t *probeTarget) {
+	delete(probeClients, key)
+	t.evicted = true
+	if t.probes == 0 {
+		t.client.Close()
+	}
+}
+
+// release ends the use of the client by a probe.
+func (t *probeTarget) release() {
+	probeClientsMu.Lock()
+	defer probeClientsMu.Unlock()
+	t.probes--
+	t.lastUsed = time.Now()
+	if t.evicted && t.probes == 0 {
+		t.client.Close()
+	}
+}
+
+// negotiateAPIVersion negotiates the api version of the client with the
+// scraper of a probe, it is retried by the next probe until the daemon answers.
+func (t *probeTarget) negotiateAPIVersion(ctx context.Context, s *dockerScraper) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.negotiate {
+		return
+	}
+	s.negotiate = true
+	s.negotiateAPIVersion(ctx)
+	t.negotiate = s.negotiate
+	// collect must not negotiate without the lock
+	s.negotiate = false
+}
+
+// probeHandler serves /probe?target=tcp://host:2376&module=default, collecting
+// the target into a fresh registry like the blackbox exporter does.
+func probeHandler(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+
+	host := query.Get("target")
+	if host == "" {
+		http.Error(writer, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(host, "://") {
+		host = "tcp://" + host
+	}
+
+	moduleName := query.Get("module")
+	if moduleName == "" {
+		moduleName = "default"
+	}
+	module, ok := probeModules[moduleName]
+	if !ok {
+		http.Error(writer, fmt.Sprintf("unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	target := module.dockerTarget(host)
+	t, err := probeClient(moduleName, target)
+	if err != nil {
+		log.WithField(logFieldDockerHost, host).WithError(err).Error("Init docker client error")
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer t.release()
+
+	timeout := module.Timeout
+	if timeout == 0 {
+		timeout = defaultProbeTimeout
+	}
+	// leave prometheus some time to receive the response
+	if v := request.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+			scrapeTimeout := time.Duration(seconds*float64(time.Second)) - 500*time.Millisecond
+			if scrapeTimeout > 0 && scrapeTimeout < timeout {
+				timeout = scrapeTimeout
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	defer cancel()
+
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Displays whether or not the probe was a success"})
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Returns how long the probe took to complete in seconds"})
+	m := newDockerMetrics()
+	probeRegistry := prometheus.NewRegistry()
+	probeRegistry.MustRegister(probeSuccess)
+	probeRegistry.MustRegister(probeDuration)
+	m.register(probeRegistry)
+
+	start := time.Now()
+	// a probe target is remote, local is false: the procfs collectors are off
+	// the host label is resolved per probe, caller supplied targets are not remembered
+	hosts := newHostLabels()
+	scraper := &dockerScraper{name: target.Name, client: t.client, metrics: m, local: false, hosts: hosts}
+	t.negotiateAPIVersion(ctx, scraper)
+	if result := scraper.collect(ctx, getRuntimeConfig()); result.err != nil {
+		log.WithFields(log.Fields{logFieldDockerHost: host, "module": moduleName}).WithError(result.err).Warn("Probe failed")
+	} else {
+		probeSuccess.Set(1)
+	}
+	probeDuration.Set(time.Since(start).Seconds())
+
+	promhttp.HandlerFor(identity.gatherer(probeRegistry, hosts), promhttp.HandlerOpts{}).ServeHTTP(writer, request)
+}
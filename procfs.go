@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procfsPath is the mount point of the host proc filesystem. When the exporter
+// runs in a container, mount the host /proc and point --procfs at it.
+var procfsPath = "/proc"
+
+// tcp states as defined in include/net/tcp_states.h
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+// socketStats holds the socket tables of one network namespace.
+type socketStats struct {
+	// tcp connections by state, LISTEN excluded
+	connections map[string]int
+	listen      int
+	// sockstat fields by protocol, e.g. sockstat["TCP"]["inuse"]
+	sockstat map[string]map[string]int
+}
+
+// readSocketStats reads /proc/<pid>/net/{tcp,tcp6,sockstat}. The net directory
+// of a process reflects its network namespace, so no setns is required.
+func readSocketStats(pid int) (*socketStats, error) {
+	netDir := filepath.Join(procfsPath, strconv.Itoa(pid), "net")
+
+	stats := &socketStats{
+		connections: make(map[string]int),
+		sockstat:    make(map[string]map[string]int),
+	}
+	for _, state := range tcpStates {
+		if state != "LISTEN" {
+			stats.connections[state] = 0
+		}
+	}
+
+	for _, name := range []string{"tcp", "tcp6"} {
+		err := readTCPTable(filepath.Join(netDir, name), stats)
+		// tcp6 is missing when ipv6 is disabled
+		if err != nil && !(name == "tcp6" && os.IsNotExist(err)) {
+			return nil, err
+		}
+	}
+
+	if err := readSockstat(filepath.Join(netDir, "sockstat"), stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func readTCPTable(path string, stats *socketStats) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// skip header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			return fmt.Errorf("%s: invalid line %q", path, scanner.Text())
+		}
+		state, ok := tcpStates[fields[3]]
+		if !ok {
+			continue
+		}
+		if state == "LISTEN" {
+			stats.listen++
+		} else {
+			stats.connections[state]++
+		}
+	}
+	return scanner.Err()
+}
+
+// readSockstat parses lines like "TCP: inuse 5 orphan 0 tw 2 alloc 7 mem 1".
+func readSockstat(path string, stats *socketStats) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || len(fields)%2 != 1 {
+			continue
+		}
+		protocol := strings.TrimSuffix(fields[0], ":")
+		values := make(map[string]int)
+		for i := 1; i < len(fields); i += 2 {
+			value, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				return fmt.Errorf("%s: invalid value %q for %s %s", path, fields[i+1], protocol, fields[i])
+			}
+			values[fields[i]] = value
+		}
+		stats.sockstat[protocol] = values
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// metricsProxy serves /containers/{name}/metrics, scraping the annotated
+// metrics endpoint of the container over the docker network and exposing its
+// series with the container labels.
+type metricsProxy struct {
+	sd      *containerSD
+	client  *http.Client
+	timeout time.Duration
+	// largest accepted response body
+	maxBytes int64
+}
+
+func newMetricsProxy(sd *containerSD, timeout time.Duration, maxBytes int64) *metricsProxy {
+	return &metricsProxy{
+		sd: sd,
+		// the request context enforces the timeout, the client one only
+		// guards against a context without deadline
+		client:   &http.Client{Timeout: 2 * timeout},
+		timeout:  timeout,
+		maxBytes: maxBytes,
+	}
+}
+
+// handler serves /containers/{name}/metrics, ?docker_host= selects the
+// daemon when the name exists on several.
+func (p *metricsProxy) handler(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(request.URL.Path, "/containers/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "metrics" {
+		http.NotFound(writer, request)
+		return
+	}
+	name := parts[0]
+
+	timeout := p.timeout
+	// leave prometheus some time to receive the response
+	if v := request.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+			scrapeTimeout := time.Duration(seconds*float64(time.Second)) - 500*time.Millisecond
+			if scrapeTimeout > 0 && scrapeTimeout < timeout {
+				timeout = scrapeTimeout
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	defer cancel()
+
+	target, status, err := p.target(ctx, name, request.URL.Query().Get("docker_host"))
+	if err != nil {
+		http.Error(writer, err.Error(), status)
+		return
+	}
+
+	families, err := p.scrape(ctx, target)
+	if err != nil {
+		containerLog(target.dockerHost, name, target.container.ID).WithError(err).Warn("Proxy container metrics error")
+		http.Error(writer, err.Error(), http.StatusBadGateway)
+		return
+	}
+	relabelFamilies(families, containerSeriesLabels(target))
+
+	format := expfmt.Negotiate(request.Header)
+	writer.Header().Set("Content-Type", string(format))
+	encoder := expfmt.NewEncoder(writer, format)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			containerLog(target.dockerHost, name, target.container.ID).WithError(err).Warn("Encode proxied container metrics error")
+			return
+		}
+	}
+}
+
+// target finds the container on the docker daemons.
+func (p *metricsProxy) target(ctx context.Context, name, dockerHost string) (containerTarget, int, error) {
+	var found []containerTarget
+	for _, scraper := range p.sd.scrapers {
+		if dockerHost != "" && scraper.name != dockerHost {
+			continue
+		}
+		start := time.Now()
+		containerJSON, err := scraper.client.ContainerInspect(ctx, name)
+		scraper.metrics.observeAPI(scraper.name, "inspect", start)
+		if err != nil {
+			continue
+		}
+		target, err := newContainerTarget(scraper.name, containerJSON, "container", "")
+		if err != nil {
+			return target, http.StatusNotFound, fmt.Errorf("container %s: %s", name, err)
+		}
+		found = append(found, target)
+	}
+	switch len(found) {
+	case 0:
+		return containerTarget{}, http.StatusNotFound, fmt.Errorf("container %s not found", name)
+	case 1:
+		return found[0], http.StatusOK, nil
+	default:
+		return containerTarget{}, http.StatusConflict, fmt.Errorf("container %s runs on several docker daemons, select one with docker_host", name)
+	}
+}
+
+// scrape fetches and parses the metrics of target, refusing bodies over maxBytes.
+func (p *metricsProxy) scrape(ctx context.Context, target containerTarget) ([]*dto.MetricFamily, error) {
+	url := fmt.Sprintf("%s://%s%s", target.scheme, target.address, target.path)
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", string(expfmt.FmtText))
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, response.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, p.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > p.maxBytes {
+		return nil, fmt.Errorf("%s response exceeds %d bytes", url, p.maxBytes)
+	}
+
+	decoder := expfmt.NewDecoder(bytes.NewReader(body), expfmt.ResponseFormat(response.Header))
+	var families []*dto.MetricFamily
+	for {
+		family := new(dto.MetricFamily)
+		if err := decoder.Decode(family); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("parse %s: %s", url, err)
+		}
+		families = append(families, family)
+	}
+	return families, nil
+}
+
+// containerSeriesLabels are the labels injected into the proxied series: the
+// container name and id like the container metrics, the mapped docker labels,
+// the constant labels and the host label.
+func containerSeriesLabels(target containerTarget) map[string]string {
+	labels := map[string]string{
+		"container_name": strings.TrimPrefix(target.container.Name, "/"),
+		"container_id":   target.container.ID[:10],
+	}
+	for label, name := range getRuntimeConfig().LabelMappings {
+		labels[name] = target.container.Config.Labels[label]
+	}
+	for name, value := range identity.labels(target.dockerHost, identity.hosts) {
+		labels[name] = value
+	}
+	return labels
+}
+
+// relabelFamilies sets labels on every series, a label the application
+// already uses is kept as exported_<name> like Prometheus does.
+func relabelFamilies(families []*dto.MetricFamily, labels map[string]string) {
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			relabelMetric(metric, labels)
+		}
+	}
+}
+
+// relabelMetric sets labels on a series like relabelFamilies.
+func relabelMetric(metric *dto.Metric, labels map[string]string) {
+	pairs := make([]*dto.LabelPair, 0, len(metric.Label)+len(labels))
+	for _, pair := range metric.Label {
+		if _, ok := labels[pair.GetName()]; ok {
+			pair.Name = proto.String("exported_" + pair.GetName())
+		}
+		pairs = append(pairs, pair)
+	}
+	for name, value := range labels {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+	metric.Label = pairs
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// registrar announces the exporter to a service discovery.
+type registrar interface {
+	// run keeps the exporter registered until ctx is done.
+	run(ctx context.Context)
+	// deregister removes the exporter, called on shutdown after run returned.
+	deregister() error
+	// registrationStatus reports whether the exporter is registered and the
+	// error of the last attempt.
+	registrationStatus() (bool, error)
+}
+
+// healthReporter is implemented by registrars whose health check reflects the
+// collection health, like the Consul TTL check.
+type healthReporter interface {
+	reportHealth(status, note string)
+}
+
+// noneRegistrar leaves service discovery to the operator.
+type noneRegistrar struct{}
+
+func (noneRegistrar) run(ctx context.Context) {}
+
+func (noneRegistrar) deregister() error { return nil }
+
+func (noneRegistrar) registrationStatus() (bool, error) { return false, nil }
+
+// fileSDGroup is a target group of the Prometheus file_sd format.
+type fileSDGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// fileSDRegistrar writes the exporter as a Prometheus file_sd target group.
+// When path is a directory it owns <service-id>.json in it, otherwise it merges
+// its group into the shared file, identified by the service_id label, and
+// leaves the groups of other exporters untouched. Writers of the shared file
+// take turns on the flock of <path>.lock.
+type fileSDRegistrar struct {
+	path      string
+	serviceID string
+	group     fileSDGroup
+	interval  time.Duration
+	// renders the tags and meta on freshly gathered host facts
+	describe func() ([]string, map[string]string, error)
+
+	mu      sync.Mutex
+	lastErr error
+	written bool
+}
+
+func newFileSDRegistrar(path string, registration *api.AgentServiceRegistration, interval time.Duration) (*fileSDRegistrar, error) {
+	if path == "" {
+		return nil, fmt.Errorf("--file-sd.path is required for the file_sd registrar")
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, registration.ID+".json")
+	}
+	switch filepath.Ext(path) {
+	case ".json", ".yml", ".yaml":
+	default:
+		return nil, fmt.Errorf("file_sd path %s must end in .json, .yml or .yaml", path)
+	}
+
+	labels := map[string]string{
+		"service":    registration.Name,
+		"service_id": registration.ID,
+	}
+	setFileSDTags(labels, registration.Tags)
+
+	return &fileSDRegistrar{
+		path:      path,
+		serviceID: registration.ID,
+		group: fileSDGroup{
+			Targets: []string{net.JoinHostPort(registration.Address, strconv.Itoa(registration.Port))},
+			Labels:  labels,
+		},
+		interval: interval,
+	}, nil
+}
+
+// run writes the target group and rewrites it whenever it went missing, e.g.
+// another writer of the shared file raced us.
+func (r *fileSDRegistrar) run(ctx context.Context) {
+	for {
+		err := r.update(true)
+		if err != nil {
+			log.WithField("file", r.path).WithError(err).Error("Write file_sd error")
+		}
+		r.mu.Lock()
+		r.written, r.lastErr = err == nil, err
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+func (r *fileSDRegistrar) deregister() error {
+	if err := r.update(false); err != nil {
+		log.WithField("file", r.path).WithError(err).Error("Remove from file_sd error")
+		return err
+	}
+	log.WithFields(log.Fields{"file": r.path, "service_id": r.serviceID}).Info("Remove from file_sd")
+	r.mu.Lock()
+	r.written = false
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *fileSDRegistrar) registrationStatus() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.written, r.lastErr
+}
+
+// update adds or removes our target group, the file is only rewritten when it
+// changes. Our group keeps its position, exporters sharing the file would
+// rewrite it in turn otherwise.
+func (r *fileSDRegistrar) update(register bool) error {
+	if register && r.describe != nil {
+		tags, _, err := r.describe()
+		if err != nil {
+			log.WithField("file", r.path).WithError(err).Warn("Render file_sd tags error")
+		} else {
+			setFileSDTags(r.group.Labels, tags)
+		}
+	}
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	groups, err := r.read()
+	if err != nil {
+		return err
+	}
+
+	var merged []fileSDGroup
+	found := false
+	for _, group := range groups {
+		if group.Labels["service_id"] != r.serviceID {
+			merged = append(merged, group)
+		} else if register && !found {
+			merged = append(merged, r.group)
+			found = true
+		}
+	}
+	if register && !found {
+		merged = append(merged, r.group)
+	}
+	if reflect.DeepEqual(groups, merged) {
+		return nil
+	}
+
+	if !register && len(merged) == 0 {
+		return os.Remove(r.path)
+	}
+	return r.write(merged)
+}
+
+// lock holds the flock of <path>.lock until unlock, so the read, merge and
+// write of another exporter cannot drop our group. The lock file stays, it is
+// never what Prometheus reads.
+func (r *fileSDRegistrar) lock() (unlock func(), err error) {
+	f, err := os.OpenFile(r.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %s", f.Name(), err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// setFileSDTags sets the tags label in the format of __meta_consul_tags.
+func setFileSDTags(labels map[string]string, tags []string) {
+	delete(labels, "tags")
+	if len(tags) > 0 {
+		labels["tags"] = "," + strings.Join(tags, ",") + ","
+	}
+}
+
+func (r *fileSDRegistrar) read() ([]fileSDGroup, error) {
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []fileSDGroup
+	if filepath.Ext(r.path) == ".json" {
+		err = json.Unmarshal(data, &groups)
+	} else {
+		err = yaml.Unmarshal(data, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", r.path, err)
+	}
+	return groups, nil
+}
+
+// write replaces the file atomically, Prometheus must never read a partial file.
+func (r *fileSDRegistrar) write(groups []fileSDGroup) error {
+	var data []byte
+	var err error
+	if filepath.Ext(r.path) == ".json" {
+		data, err = json.MarshalIndent(groups, "", "  ")
+	} else {
+		data, err = yaml.Marshal(groups)
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), "."+filepath.Base(r.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
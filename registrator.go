@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// container labels read by the registrator
+const (
+	labelServiceName    = "consul.service.name"
+	labelServiceTags    = "consul.service.tags"
+	labelServiceMeta    = "consul.service.meta."
+	labelServiceNetwork = "consul.service.network"
+	labelPrometheusPort = "prometheus.port"
+	labelPrometheusPath = "prometheus.path"
+)
+
+// service meta marking the services owned by a registrator
+const (
+	registratorMetaOwner      = "registrator"
+	registratorMetaOwnerValue = "prometheus_docker_exporter"
+	registratorMetaDockerHost = "docker_host"
+)
+
+var registratorServices = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "consul_registrator_services",
+	Help: "the number of containers registered as Consul services."})
+
+// containerRegistrator registers the containers labelled consul.service.name
+// as Consul services. It follows the docker events and resyncs every interval,
+// so missed events and agent restarts are repaired.
+type containerRegistrator struct {
+	client *client.Client
+	consul *consulConnector
+	// docker_host label and metrics of the events request latency
+	dockerHost string
+	metrics    *dockerMetrics
+	// docker host name, the services of other hosts on the agent are left alone
+	hostname string
+	// "container" registers the container address, "host" the published port
+	addressMode string
+	// address of published ports bound to all interfaces
+	hostAddress string
+	interval    time.Duration
+	checkTTL    time.Duration
+
+	mu sync.Mutex
+	// service ids by container id
+	services map[string]string
+}
+
+func newContainerRegistrator(cli *client.Client, consul *consulConnector, hostname, addressMode, hostAddress string, interval, checkTTL time.Duration) (*containerRegistrator, error) {
+	switch addressMode {
+	case "container", "host":
+	default:
+		return nil, fmt.Errorf("unknown registrator address %q, use container or host", addressMode)
+	}
+	registry.MustRegister(registratorServices)
+	return &containerRegistrator{
+		client:      cli,
+		consul:      consul,
+		hostname:    hostname,
+		addressMode: addressMode,
+		hostAddress: hostAddress,
+		interval:    interval,
+		checkTTL:    checkTTL,
+		services:    make(map[string]string),
+	}, nil
+}
+
+// run follows the docker events until ctx is done, reconnecting with backoff.
+func (r *containerRegistrator) run(ctx context.Context) {
+	backoff := consulMinBackoff
+	for {
+		r.sync(ctx)
+		err := r.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithField("retry_in", backoff).WithError(err).Error("Registrator docker events error")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > consulMaxBackoff {
+			backoff = consulMaxBackoff
+		}
+	}
+}
+
+// watch handles container events and resyncs every interval until the event
+// stream fails.
+func (r *containerRegistrator) watch(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	args := filters.NewArgs()
+	args.Add("type", "container")
+	args.Add("label", labelServiceName)
+	start := time.Now()
+	messages, errs := r.client.Events(ctx, types.EventsOptions{Filters: args})
+	// the stream stays open, its latency is the time to the first message or error
+	observe := func() {
+		if r.metrics != nil && !start.IsZero() {
+			r.metrics.observeAPI(r.dockerHost, "events", start)
+			start = time.Time{}
+		}
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-messages:
+			observe()
+			switch {
+			case message.Action == "start":
+				r.register(ctx, message.Actor.ID)
+			case message.Action == "die":
+				r.deregisterContainer(message.Actor.ID)
+			case strings.HasPrefix(message.Action, "health_status"):
+				r.register(ctx, message.Actor.ID)
+			}
+		case err := <-errs:
+			observe()
+			return err
+		case <-ticker.C:
+			r.sync(ctx)
+		}
+	}
+}
+
+// sync registers every running labelled container and removes the services of
+// containers that are gone.
+func (r *containerRegistrator) sync(ctx context.Context) {
+	args := filters.NewArgs()
+	args.Add("label", labelServiceName)
+	containers, err := r.client.ContainerList(ctx, types.ContainerListOptions{Filters: args})
+	if err != nil {
+		log.WithError(err).Error("Registrator list containers error")
+		return
+	}
+	running := make(map[string]bool)
+	for _, container := range containers {
+		running[container.ID] = true
+		r.register(ctx, container.ID)
+	}
+
+	consulClient, err := r.consul.client()
+	if err != nil {
+		log.WithError(err).Error("Registrator Consul error")
+		return
+	}
+	services, err := consulClient.Agent().Services()
+	if err != nil {
+		log.WithError(err).Error("Registrator list Consul services error")
+		r.consul.failover()
+		return
+	}
+	for id, service := range services {
+		if service.Meta[registratorMetaOwner] != registratorMetaOwnerValue ||
+			service.Meta[registratorMetaDockerHost] != r.hostname {
+			continue
+		}
+		if containerID := service.Meta["container_id"]; !running[containerID] {
+			r.deregisterService(consulClient, containerID, id)
+		}
+	}
+}
+
+// register inspects the container and registers or updates its service.
+func (r *containerRegistrator) register(ctx context.Context, containerID string) {
+	containerJSON, err := r.client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		log.WithField(logFieldContainerID, containerID).WithError(err).Error("Registrator inspect container error")
+		return
+	}
+	logger := containerLog(r.hostname, strings.TrimPrefix(containerJSON.Name, "/"), containerJSON.ID)
+	if containerJSON.State == nil || !containerJSON.State.Running ||
+		containerJSON.Config == nil || containerJSON.Config.Labels[labelServiceName] == "" {
+		return
+	}
+	registration, err := r.registration(containerJSON)
+	if err != nil {
+		logger.WithError(err).Warn("Registrator skip container")
+		return
+	}
+
+	consulClient, err := r.consul.client()
+	if err != nil {
+		logger.WithError(err).Error("Registrator Consul error")
+		return
+	}
+	if err := consulClient.Agent().ServiceRegister(registration); err != nil {
+		logger.WithField("service_id", registration.ID).WithError(err).Error("Registrator register error")
+		r.consul.failover()
+		return
+	}
+
+	r.mu.Lock()
+	if _, ok := r.services[containerJSON.ID]; !ok {
+		logger.WithFields(log.Fields{
+			"service_name":    registration.Name,
+			"service_id":      registration.ID,
+			"service_address": registration.Address,
+			"service_port":    registration.Port,
+		}).Info("Register container service")
+	}
+	r.services[containerJSON.ID] = registration.ID
+	registratorServices.Set(float64(len(r.services)))
+	r.mu.Unlock()
+
+	// mirror the docker HEALTHCHECK, refreshing the TTL
+	if health := containerJSON.State.Health; health != nil {
+		status, note := containerHealthStatus(health)
+		if err := consulClient.Agent().UpdateTTL("service:"+registration.ID, note, status); err != nil {
+			logger.WithField("service_id", registration.ID).WithError(err).Warn("Registrator update TTL check error")
+		}
+	}
+}
+
+// containerHealthStatus maps the docker health to a Consul check status.
+func containerHealthStatus(health *types.Health) (string, string) {
+	status, note := api.HealthWarning, "health check starting"
+	switch health.Status {
+	case types.Healthy:
+		status, note = api.HealthPassing, "healthy"
+	case types.Unhealthy:
+		status, note = api.HealthCritical, "unhealthy"
+	}
+	if n := len(health.Log); n > 0 && health.Log[n-1].Output != "" {
+		note = strings.TrimSpace(health.Log[n-1].Output)
+	}
+	return status, note
+}
+
+// registration builds the service of a labelled container.
+func (r *containerRegistrator) registration(containerJSON types.ContainerJSON) (*api.AgentServiceRegistration, error) {
+	labels := containerJSON.Config.Labels
+	name := strings.TrimPrefix(containerJSON.Name, "/")
+
+	port, err := metricsPort(labels[labelPrometheusPort], containerJSON.Config.ExposedPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	registration := &api.AgentServiceRegistration{
+		ID:   fmt.Sprintf("%s:%s:%d", r.hostname, name, port.Int()),
+		Name: labels[labelServiceName],
+		Meta: map[string]string{
+			registratorMetaOwner:      registratorMetaOwnerValue,
+			registratorMetaDockerHost: r.hostname,
+			"container_id":            containerJSON.ID,
+			"container_name":          name,
+			"image":                   containerJSON.Config.Image,
+		},
+	}
+	if path := labels[labelPrometheusPath]; path != "" {
+		registration.Meta["metrics_path"] = path
+	}
+	if project := labels["com.docker.compose.project"]; project != "" {
+		registration.Meta["compose_project"] = project
+		registration.Meta["compose_service"] = labels["com.docker.compose.service"]
+	}
+	for key, value := range labels {
+		if strings.HasPrefix(key, labelServiceMeta) {
+			registration.Meta[strings.TrimPrefix(key, labelServiceMeta)] = value
+		}
+	}
+	for _, tag := range strings.Split(labels[labelServiceTags], ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			registration.Tags = append(registration.Tags, tag)
+		}
+	}
+
+	if r.addressMode == "host" {
+		registration.Address, registration.Port, err = r.publishedAddress(containerJSON, port)
+	} else {
+		registration.Address, err = containerAddress(containerJSON, labels[labelServiceNetwork])
+		registration.Port = port.Int()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if health := containerJSON.State.Health; health != nil {
+		// registering again must not reset the check to critical
+		status, _ := containerHealthStatus(health)
+		registration.Check = &api.AgentServiceCheck{
+			CheckID: "service:" + registration.ID,
+			TTL:     r.checkTTL.String(),
+			Status:  status,
+			Notes:   "mirrors the docker HEALTHCHECK of " + name,
+		}
+	}
+	return registration, nil
+}
+
+// metricsPort is the prometheus.port label or the only exposed port.
+func metricsPort(label string, exposed nat.PortSet) (nat.Port, error) {
+	if label != "" {
+		if !strings.Contains(label, "/") {
+			label += "/tcp"
+		}
+		proto, port := nat.SplitProtoPort(label)
+		return nat.NewPort(proto, port)
+	}
+	if len(exposed) == 1 {
+		for port := range exposed {
+			return port, nil
+		}
+	}
+	return "", fmt.Errorf("no %s label and %d exposed ports", labelPrometheusPort, len(exposed))
+}
+
+// containerAddress returns the container IP on network or on its first network.
+func containerAddress(containerJSON types.ContainerJSON, network string) (string, error) {
+	if containerJSON.NetworkSettings == nil || len(containerJSON.NetworkSettings.Networks) == 0 {
+		return "", fmt.Errorf("container has no network")
+	}
+	networks := containerJSON.NetworkSettings.Networks
+	if network == "" {
+		names := make([]string, 0, len(networks))
+		for name := range networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		network = names[0]
+	}
+	settings, ok := networks[network]
+	if !ok || settings == nil {
+		return "", fmt.Errorf("container is not attached to network %s", network)
+	}
+	if settings.IPAddress != "" {
+		return settings.IPAddress, nil
+	}
+	if settings.GlobalIPv6Address != "" {
+		return settings.GlobalIPv6Address, nil
+	}
+	return "", fmt.Errorf("container has no address on network %s", network)
+}
+
+// publishedAddress returns the host address and port port is published on.
+func (r *containerRegistrator) publishedAddress(containerJSON types.ContainerJSON, port nat.Port) (string, int, error) {
+	if containerJSON.NetworkSettings == nil {
+		return "", 0, fmt.Errorf("port %s is not published", port)
+	}
+	for _, binding := range containerJSON.NetworkSettings.Ports[port] {
+		hostPort, err := strconv.Atoi(binding.HostPort)
+		if err != nil {
+			continue
+		}
+		address := binding.HostIP
+		if ip := net.ParseIP(address); ip == nil || ip.IsUnspecified() {
+			address = r.hostAddress
+		}
+		return address, hostPort, nil
+	}
+	return "", 0, fmt.Errorf("port %s is not published", port)
+}
+
+func (r *containerRegistrator) deregisterContainer(containerID string) {
+	r.mu.Lock()
+	serviceID, ok := r.services[containerID]
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	consulClient, err := r.consul.client()
+	if err != nil {
+		log.WithField(logFieldContainerID, containerID).WithError(err).Error("Registrator Consul error")
+		return
+	}
+	r.deregisterService(consulClient, containerID, serviceID)
+}
+
+func (r *containerRegistrator) deregisterService(consulClient *api.Client, containerID, serviceID string) {
+	if err := consulClient.Agent().ServiceDeregister(serviceID); err != nil {
+		log.WithField("service_id", serviceID).WithError(err).Error("Registrator deregister error")
+		return
+	}
+	log.WithField("service_id", serviceID).Info("Deregister container service")
+	r.mu.Lock()
+	delete(r.services, containerID)
+	registratorServices.Set(float64(len(r.services)))
+	r.mu.Unlock()
+}
+
+// deregister removes every container service, nobody keeps their TTL checks
+// and addresses up to date after the exporter stopped.
+func (r *containerRegistrator) deregister() {
+	consulClient, err := r.consul.client()
+	if err != nil {
+		log.WithError(err).Error("Registrator Consul error")
+		return
+	}
+	r.mu.Lock()
+	services := make(map[string]string, len(r.services))
+	for containerID, serviceID := range r.services {
+		services[containerID] = serviceID
+	}
+	r.mu.Unlock()
+	for containerID, serviceID := range services {
+		r.deregisterService(consulClient, containerID, serviceID)
+	}
+}
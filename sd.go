@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	log "github.com/sirupsen/logrus"
+)
+
+// container labels opting in to be scraped
+const (
+	labelScrape  = "prometheus.io/scrape"
+	labelPort    = "prometheus.io/port"
+	labelPath    = "prometheus.io/path"
+	labelScheme  = "prometheus.io/scheme"
+	labelNetwork = "prometheus.io/network"
+)
+
+const sdTimeout = 30 * time.Second
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// containerTarget is the metrics endpoint of an annotated container.
+type containerTarget struct {
+	dockerHost string
+	container  types.ContainerJSON
+	// host:port Prometheus scrapes
+	address string
+	path    string
+	scheme  string
+	network string
+	ip      string
+	// container port and the published host port, if any
+	privatePort int
+	publicPort  int
+}
+
+// containerSD resolves the scrape targets of the containers of all docker daemons.
+type containerSD struct {
+	scrapers []*dockerScraper
+	// "container" or "host", the default of the address parameter
+	addressMode string
+	// address of ports published on all interfaces of a local daemon
+	hostAddress string
+}
+
+// targets lists the annotated running containers of every daemon. A daemon
+// that fails is logged and left out.
+func (sd *containerSD) targets(ctx context.Context, addressMode string) []containerTarget {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var targets []containerTarget
+	for _, scraper := range sd.scrapers {
+		wg.Add(1)
+		go func(scraper *dockerScraper) {
+			defer wg.Done()
+			scraperTargets, err := sd.daemonTargets(ctx, scraper, addressMode)
+			if err != nil {
+				log.WithField(logFieldDockerHost, scraper.name).WithError(err).Error("Service discovery error")
+				return
+			}
+			mu.Lock()
+			targets = append(targets, scraperTargets...)
+			mu.Unlock()
+		}(scraper)
+	}
+	wg.Wait()
+
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].dockerHost != targets[j].dockerHost {
+			return targets[i].dockerHost < targets[j].dockerHost
+		}
+		return targets[i].container.Name < targets[j].container.Name
+	})
+	return targets
+}
+
+func (sd *containerSD) daemonTargets(ctx context.Context, scraper *dockerScraper, addressMode string) ([]containerTarget, error) {
+	args := filters.NewArgs()
+	args.Add("label", labelScrape+"=true")
+	start := time.Now()
+	containers, err := scraper.client.ContainerList(ctx, types.ContainerListOptions{Filters: args})
+	scraper.metrics.observeAPI(scraper.name, "list", start)
+	if err != nil {
+		return nil, err
+	}
+
+	hostAddress := sd.hostAddress
+	if u, err := url.Parse(scraper.client.DaemonHost()); err == nil && u.Scheme == "tcp" {
+		hostAddress = u.Hostname()
+	}
+
+	var targets []containerTarget
+	for _, container := range containers {
+		start := time.Now()
+		containerJSON, err := scraper.client.ContainerInspect(ctx, container.ID)
+		scraper.metrics.observeAPI(scraper.name, "inspect", start)
+		if err != nil {
+			containerLog(scraper.name, "", container.ID).WithError(err).Warn("Service discovery inspect container error")
+			continue
+		}
+		target, err := newContainerTarget(scraper.name, containerJSON, addressMode, hostAddress)
+		if err != nil {
+			containerLog(scraper.name, strings.TrimPrefix(containerJSON.Name, "/"), containerJSON.ID).WithError(err).Debug("Service discovery skip container")
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// newContainerTarget resolves the metrics endpoint of a container from its
+// prometheus.io labels.
+func newContainerTarget(dockerHost string, containerJSON types.ContainerJSON, addressMode, hostAddress string) (containerTarget, error) {
+	target := containerTarget{dockerHost: dockerHost, container: containerJSON, path: "/metrics", scheme: "http"}
+	if containerJSON.Config == nil || containerJSON.State == nil || !containerJSON.State.Running {
+		return target, fmt.Errorf("container is not running")
+	}
+	labels := containerJSON.Config.Labels
+	if labels[labelScrape] != "true" {
+		return target, fmt.Errorf("container is not labelled %s=true", labelScrape)
+	}
+	if path := labels[labelPath]; path != "" {
+		target.path = path
+	}
+	if scheme := labels[labelScheme]; scheme != "" {
+		target.scheme = scheme
+	}
+
+	port, err := metricsPort(labels[labelPort], containerJSON.Config.ExposedPorts)
+	if err != nil {
+		return target, err
+	}
+	target.privatePort = port.Int()
+	if containerJSON.NetworkSettings != nil {
+		for _, binding := range containerJSON.NetworkSettings.Ports[port] {
+			if hostPort, err := strconv.Atoi(binding.HostPort); err == nil {
+				target.publicPort = hostPort
+				if ip := net.ParseIP(binding.HostIP); ip != nil && !ip.IsUnspecified() {
+					hostAddress = binding.HostIP
+				}
+				break
+			}
+		}
+	}
+
+	target.network = labels[labelNetwork]
+	if target.network == "" && containerJSON.NetworkSettings != nil {
+		names := make([]string, 0, len(containerJSON.NetworkSettings.Networks))
+		for name := range containerJSON.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			target.network = names[0]
+		}
+	}
+	if ip, err := containerAddress(containerJSON, target.network); err == nil {
+		target.ip = ip
+	}
+
+	switch addressMode {
+	case "host":
+		if target.publicPort == 0 {
+			return target, fmt.Errorf("port %s is not published", port)
+		}
+		target.address = net.JoinHostPort(hostAddress, strconv.Itoa(target.publicPort))
+	default:
+		if target.ip == "" {
+			return target, fmt.Errorf("container has no address on network %q", target.network)
+		}
+		target.address = net.JoinHostPort(target.ip, strconv.Itoa(target.privatePort))
+	}
+	return target, nil
+}
+
+// group is the target as http_sd target group with the labels of the
+// Prometheus docker_sd_config.
+func (t containerTarget) group() fileSDGroup {
+	name := t.container.Name
+	if len(name) > 0 && name[0] == '/' {
+		name = name[1:]
+	}
+	labels := map[string]string{
+		"__metrics_path__":              t.path,
+		"__scheme__":                    t.scheme,
+		"__meta_docker_host":            t.dockerHost,
+		"__meta_docker_container_id":    t.container.ID,
+		"__meta_docker_container_name":  name,
+		"__meta_docker_container_image": t.container.Config.Image,
+		"__meta_docker_network_name":    t.network,
+		"__meta_docker_network_ip":      t.ip,
+		"__meta_docker_port_private":    strconv.Itoa(t.privatePort),
+	}
+	if t.publicPort != 0 {
+		labels["__meta_docker_port_public"] = strconv.Itoa(t.publicPort)
+	}
+	for key, value := range t.container.Config.Labels {
+		labels["__meta_docker_container_label_"+invalidLabelChars.ReplaceAllString(key, "_")] = value
+	}
+	return fileSDGroup{Targets: []string{t.address}, Labels: labels}
+}
+
+// handler serves /sd in the http_sd_config format, ?address=host lists the
+// published host ports instead of the container addresses.
+func (sd *containerSD) handler(writer http.ResponseWriter, request *http.Request) {
+	addressMode := request.URL.Query().Get("address")
+	if addressMode == "" {
+		addressMode = sd.addressMode
+	}
+	if addressMode != "container" && addressMode != "host" {
+		http.Error(writer, fmt.Sprintf("unknown address %q, use container or host", addressMode), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), sdTimeout)
+	defer cancel()
+	groups := []fileSDGroup{}
+	for _, target := range sd.targets(ctx, addressMode) {
+		groups = append(groups, target.group())
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(groups)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultSelectionTimeout bounds an on demand collection without scrape timeout header.
+const defaultSelectionTimeout = 30 * time.Second
+
+// containerSelector matches the name or a label of a container like a
+// Prometheus label matcher.
+type containerSelector struct {
+	// empty for the container name
+	label string
+	// =, !=, =~ or !~, empty when the label only has to exist
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+var labelSelectorPattern = regexp.MustCompile(`^([^=!~]+)(=~|!~|!=|=)?(.*)$`)
+
+// parseSelectors parses the name and label parameters of a request:
+//
+//	name=api-1 name=~api-.* name!=api-1 name!=~api-.*
+//	label=team label=team=payments label=team!=payments label=team=~pay.* label=team!~pay.*
+//
+// A name!=... parameter arrives with the name! key.
+func parseSelectors(query url.Values) ([]containerSelector, error) {
+	var selectors []containerSelector
+	for key := range query {
+		if strings.HasPrefix(key, "name") && key != "name" && key != "name!" {
+			return nil, fmt.Errorf("invalid name selector %q, use name=, name!=, name=~ or name!=~", key)
+		}
+	}
+	for _, key := range []string{"name", "name!"} {
+		for _, value := range query[key] {
+			selector := containerSelector{op: "=", value: value}
+			if strings.HasPrefix(value, "~") {
+				selector.op, selector.value = "=~", value[1:]
+			}
+			if key == "name!" {
+				selector.op = map[string]string{"=": "!=", "=~": "!~"}[selector.op]
+			}
+			selectors = append(selectors, selector)
+		}
+	}
+	for _, value := range query["label"] {
+		parts := labelSelectorPattern.FindStringSubmatch(value)
+		if parts == nil || (parts[2] == "" && parts[3] != "") {
+			return nil, fmt.Errorf("invalid label selector %q", value)
+		}
+		selectors = append(selectors, containerSelector{label: parts[1], op: parts[2], value: parts[3]})
+	}
+
+	for i := range selectors {
+		if selectors[i].op == "=~" || selectors[i].op == "!~" {
+			re, err := regexp.Compile("^(?:" + selectors[i].value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("selector %q: %s", selectors[i].value, err)
+			}
+			selectors[i].re = re
+		}
+	}
+	return selectors, nil
+}
+
+// matches reports whether the container is selected.
+func (s containerSelector) matches(container types.Container) bool {
+	value, ok := container.Names[0][1:], true
+	if s.label != "" {
+		value, ok = container.Labels[s.label]
+	}
+	switch s.op {
+	case "":
+		return ok
+	case "=":
+		return value == s.value
+	case "!=":
+		return value != s.value
+	case "=~":
+		return s.re.MatchString(value)
+	case "!~":
+		return !s.re.MatchString(value)
+	}
+	return false
+}
+
+// metricsHandler serves the metrics of the background collection, or, when
+// the request has collect[], name or label parameters, collects the selected
+// collectors and containers on demand into a fresh registry.
+func metricsHandler(scrapers []*dockerScraper) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		collectors := query["collect[]"]
+		selectors, err := parseSelectors(query)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(collectors) == 0 && len(selectors) == 0 {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		if contains(collectors, "events") {
+			http.Error(writer, "the events collector is not collected on demand", http.StatusBadRequest)
+			return
+		}
+		config, err := getRuntimeConfig().withSelection(collectors, selectors)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		timeout := defaultSelectionTimeout
+		// leave prometheus some time to receive the response
+		if v := request.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+			if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+				scrapeTimeout := time.Duration(seconds*float64(time.Second)) - 500*time.Millisecond
+				if scrapeTimeout > 0 && scrapeTimeout < timeout {
+					timeout = scrapeTimeout
+				}
+			}
+		}
+		ctx, cancel := context.WithTimeout(request.Context(), timeout)
+		defer cancel()
+
+		m := newDockerMetrics()
+		selectionRegistry := prometheus.NewRegistry()
+		m.register(selectionRegistry)
+		var wg sync.WaitGroup
+		for _, scraper := range scrapers {
+			wg.Add(1)
+			go func(scraper *dockerScraper) {
+				defer wg.Done()
+				selection := &dockerScraper{name: scraper.name, client: scraper.client, metrics: m, timeout: scraper.timeout, local: scraper.local, hosts: scraper.hosts}
+				if result := selection.collect(ctx, config); result.err != nil {
+					log.WithField(logFieldDockerHost, scraper.name).WithError(result.err).Warn("On demand collection failed")
+				}
+			}(scraper)
+		}
+		wg.Wait()
+
+		promhttp.HandlerFor(identity.gatherer(selectionRegistry, identity.hosts), promhttp.HandlerOpts{}).ServeHTTP(writer, request)
+	}
+}
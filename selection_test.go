@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestParseSelectors(t *testing.T) {
+	containers := []types.Container{
+		{Names: []string{"/api-1"}, Labels: map[string]string{"team": "payments"}},
+		{Names: []string{"/api-2"}, Labels: map[string]string{"team": "search"}},
+		{Names: []string{"/db"}},
+	}
+
+	tests := []struct {
+		query   string
+		want    []string
+		wantErr bool
+	}{
+		{query: "name=api-1", want: []string{"api-1"}},
+		{query: "name=~api-.*", want: []string{"api-1", "api-2"}},
+		{query: "name!=api-1", want: []string{"api-2", "db"}},
+		{query: "name!=~api-.*", want: []string{"db"}},
+		{query: "name=~api", want: nil},
+		{query: "label=team", want: []string{"api-1", "api-2"}},
+		{query: "label=team=payments", want: []string{"api-1"}},
+		{query: "label=team!=payments", want: []string{"api-2", "db"}},
+		{query: "label=team=~pay.*", want: []string{"api-1"}},
+		{query: "label=team!~pay.*", want: []string{"api-2", "db"}},
+		{query: "name=~api-.*&label=team!=search", want: []string{"api-1"}},
+		{query: "name=~api-(", wantErr: true},
+		{query: "label=team=~pay(", wantErr: true},
+		{query: "label==payments", wantErr: true},
+		{query: "nameX=api-1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatalf("%s: %s", test.query, err)
+		}
+		selectors, err := parseSelectors(query)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.query, err)
+			continue
+		}
+
+		var got []string
+	containers:
+		for _, container := range containers {
+			for _, selector := range selectors {
+				if !selector.matches(container) {
+					continue containers
+				}
+			}
+			got = append(got, container.Names[0][1:])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: selected %v, want %v", test.query, got, test.want)
+		}
+	}
+}
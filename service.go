@@ -1,52 +1,73 @@
 package main
 
 import (
+	"crypto/tls"
 	"math/rand"
 	"time"
 
 	"fmt"
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/go-sockaddr/template"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
-	"runtime"
+	"net"
+	"strconv"
+	"strings"
 )
 
+// serviceRegistrar announces the exporter, set up and run by metricServer
+var serviceRegistrar registrar
+
 func before(c *cli.Context) error {
-	// debug level if requested by user
-	if c.Bool("debug") {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.WarnLevel)
+	// the file sets the flags the command line and the environment leave unset
+	if path := c.String("config.file"); path != "" {
+		reloader, err := newConfigReloader(c, path)
+		if err != nil {
+			return err
+		}
+		fileConfig = reloader
 	}
-	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
-
-	consulConfig := api.DefaultConfig()
-
-	// setting consul
-	consulConfig.Address = c.String("consul-address")
-	consulConfig.Datacenter = c.String("consul-dc")
 
-	consulToken := c.String("consul-token")
-	if consulToken != "" {
-		consulConfig.Token = consulToken
+	if err := setDefaultCollectors(c); err != nil {
+		return err
 	}
 
-	consulUsername := c.String("consul-username")
-	consulPassword := c.String("consul-password")
-	if consulUsername != "" && consulPassword != "" {
-		consulHttpAuth := &api.HttpBasicAuth{
-			Username: consulUsername,
-			Password: consulPassword,
-		}
-		consulConfig.HttpAuth = consulHttpAuth
+	level := c.String("log.level")
+	// debug level if requested by user
+	if c.Bool("debug") {
+		level = "debug"
+	}
+	if err := setupLogging(level, c.String("log.format")); err != nil {
+		return err
 	}
 
-	client, err := api.NewClient(consulConfig)
+	// namespace, constant labels and host label of the series
+	id, err := newMetricsIdentity(c)
 	if err != nil {
-		log.Error("Init Consul client error: ", err)
 		return err
 	}
+	identity = id
+	gather = identity.gatherer(registry, identity.hosts)
+	handler = promhttp.HandlerFor(gather, promhttp.HandlerOpts{})
+
+	procfsPath = c.String("procfs")
+	sysfsPath = c.String("sysfs")
+
+	return nil
+}
+
+// newRegistrar builds the service registration from the --service-* flags,
+// rendering tag and meta templates with facts, and the registrar selected by
+// --registrar. The http check uses https when serverTLS is set, and is refused
+// for Consul when its client_auth_type requires a client certificate the
+// agent cannot present. The
+// registrar renders the templates again on gatherFacts when it syncs, so the
+// facts of a daemon that was down or upgraded catch up.
+func newRegistrar(c *cli.Context, facts serviceFacts, gatherFacts func() serviceFacts, serverTLS *tlsServerConfig) (registrar, error) {
+	// no service address needed without service discovery
+	if c.String("registrar") == "none" {
+		return noneRegistrar{}, nil
+	}
 
 	// service register info
 	registration := new(api.AgentServiceRegistration)
@@ -56,83 +77,203 @@ func before(c *cli.Context) error {
 	consulServiceID := c.String("service-id")
 	if consulServiceID == "" {
 		consulServiceID = "prometheus-docker-metrics-" + consulServiceIDSuffix()
-		log.Warn("Consul service id is not setting, use default ", consulServiceID)
+		log.WithField("service_id", consulServiceID).Warn("Consul service id is not set, use the default")
 	}
 	registration.ID = consulServiceID
 
-	serviceIP := c.String("service-ip")
-	if serviceIP == "" {
-		// use eth0 network interface ipv4 address
-		// mac os
-		if runtime.GOOS == "darwin" {
-			serviceIP, err = template.Parse(`{{ GetInterfaceIP "en0" }}`)
-		} else {
-			serviceIP, err = template.Parse(`{{ GetInterfaceIP "eth0" }}`)
-		}
-		if err != nil {
-			serviceIP = "127.0.0.1"
-		}
-		log.Warn("Consul service ip is not setting, use container ip ", serviceIP)
+	addresses, err := resolveServiceAddresses(c.String("service-ip"), c.String("service-ip-family"), c.Bool("service-allow-loopback"))
+	if err != nil {
+		return nil, err
 	}
-	registration.Address = serviceIP
+	log.WithField("service_address", addresses.address).Info("Consul service address")
+	registration.Address = addresses.address
 
 	servicePort := c.Uint("service-port")
 	if servicePort == 0 || servicePort > 65535 {
-		log.Warn("Consul service id invalid, use default (8765)")
+		log.WithField("service_port", 8765).Warn("Consul service port invalid, use the default")
 		servicePort = 8765
 	}
 	registration.Port = int(servicePort)
 
-	consulServiceTag := c.StringSlice("service-tags")
-	if consulServiceTag != nil {
-		registration.Tags = consulServiceTag
+	describe := func(facts serviceFacts) ([]string, map[string]string, error) {
+		tags, meta, err := describeService(c, facts)
+		if err != nil {
+			return nil, nil, err
+		}
+		// dual stack, the agent API has no tagged addresses to register both
+		if addresses.ipv4 != "" {
+			meta["address_ipv4"] = addresses.ipv4
+		}
+		if addresses.ipv6 != "" {
+			meta["address_ipv6"] = addresses.ipv6
+		}
+		return tags, meta, nil
+	}
+	registration.Tags, registration.Meta, err = describe(facts)
+	if err != nil {
+		return nil, err
+	}
+	redescribe := func() ([]string, map[string]string, error) {
+		return describe(gatherFacts())
 	}
 
 	check := new(api.AgentServiceCheck)
-	check.HTTP = fmt.Sprintf("http://%s:%d/%s", registration.Address, registration.Port, "health")
-	check.Timeout = "3s"
-	check.Interval = "30s"
-	check.Method = "GET"
+	switch c.String("consul-check") {
+	case "http":
+		scheme := "http"
+		if serverTLS != nil {
+			switch tlsClientAuthTypes[serverTLS.ClientAuthType] {
+			case tls.RequireAnyClientCert, tls.RequireAndVerifyClientCert:
+				if c.String("registrar") == "consul" {
+					return nil, fmt.Errorf("--consul-check=http cannot pass the web config client_auth_type %s, use --consul-check=ttl", serverTLS.ClientAuthType)
+				}
+			}
+			// the certificate rarely names the service address
+			scheme = "https"
+			check.TLSSkipVerify = true
+		}
+		check.HTTP = fmt.Sprintf("%s://%s/%s", scheme, net.JoinHostPort(registration.Address, strconv.Itoa(registration.Port)), "ready")
+		check.Timeout = c.Duration("consul-check-timeout").String()
+		check.Interval = c.Duration("consul-check-interval").String()
+		check.Method = "GET"
+	case "ttl":
+		// updated by the collection loop, so it has to outlive a collect interval
+		ttl := c.Duration("consul-check-ttl")
+		if ttl <= c.Duration("collect-interval") {
+			ttl = 2 * c.Duration("collect-interval")
+			log.WithField("ttl", ttl).Warn("Consul check ttl must be longer than the collect interval")
+		}
+		check.CheckID = "service:" + registration.ID
+		check.TTL = ttl.String()
+		check.Notes = "updated with the docker collection health"
+	default:
+		return nil, fmt.Errorf("unknown consul check %q, use http or ttl", c.String("consul-check"))
+	}
+	if after := c.Duration("consul-deregister-critical-after"); after > 0 {
+		check.DeregisterCriticalServiceAfter = after.String()
+	}
 	registration.Check = check
 
-	err = client.Agent().ServiceRegister(registration)
+	switch c.String("registrar") {
+	case "consul":
+		manager := newConsulManager(newConsulConnector(c), registration, c.Duration("registrar-sync-interval"))
+		manager.describe = redescribe
+		return manager, nil
+	case "file_sd":
+		fileSD, err := newFileSDRegistrar(c.String("file-sd.path"), registration, c.Duration("registrar-sync-interval"))
+		if err != nil {
+			return nil, err
+		}
+		fileSD.describe = redescribe
+		return fileSD, nil
+	default:
+		return nil, fmt.Errorf("unknown registrar %q, use consul, file_sd or none", c.String("registrar"))
+	}
+}
+
+// describeService renders the --service-tags and --service-meta templates on
+// the host facts.
+func describeService(c *cli.Context, facts serviceFacts) ([]string, map[string]string, error) {
+	var tags []string
+	for _, tag := range c.StringSlice("service-tags") {
+		tag, err := renderServiceTemplate(tag, facts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid service tag: %s", err)
+		}
+		tags = append(tags, tag)
+	}
+
+	meta := facts.meta()
+	for _, item := range c.StringSlice("service-meta") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, nil, fmt.Errorf("invalid service meta %q, use key=value", item)
+		}
+		value, err := renderServiceTemplate(parts[1], facts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid service meta %s: %s", parts[0], err)
+		}
+		meta[parts[0]] = value
+	}
+	return tags, meta, nil
+}
+
+// newRegistrator creates the registrator of the containers of the docker
+// daemon of scraper from the --registrator.* flags.
+func newRegistrator(c *cli.Context, scraper *dockerScraper, facts serviceFacts) (*containerRegistrator, error) {
+	var hostAddress string
+	if c.String("registrator.address") == "host" {
+		addresses, err := resolveServiceAddresses(c.String("service-ip"), c.String("service-ip-family"), c.Bool("service-allow-loopback"))
+		if err != nil {
+			return nil, err
+		}
+		hostAddress = addresses.address
+	}
+	r, err := newContainerRegistrator(scraper.client, newConsulConnector(c), facts.Hostname,
+		c.String("registrator.address"), hostAddress,
+		c.Duration("registrar-sync-interval"), c.Duration("registrator.check-ttl"))
 	if err != nil {
-		log.Error("Register Consul service error: ", err)
-		return err
+		return nil, err
 	}
-	log.Infof("Register consul service: %s, %s, %s, %d",
-		registration.Name,
-		registration.ID,
-		registration.Address,
-		registration.Port)
+	r.dockerHost, r.metrics = scraper.name, scraper.metrics
+	return r, nil
+}
 
-	return nil
+// newContainerSD creates the container service discovery of the --sd.* flags.
+// Ports published on all interfaces of a local docker daemon are announced on
+// the service address, or the host name when it cannot be resolved.
+func newContainerSD(c *cli.Context, scrapers []*dockerScraper, facts serviceFacts) *containerSD {
+	hostAddress := facts.Hostname
+	addresses, err := resolveServiceAddresses(c.String("service-ip"), c.String("service-ip-family"), c.Bool("service-allow-loopback"))
+	if err != nil {
+		log.WithError(err).Debug("Service discovery uses the host name, resolve service address error")
+	} else {
+		hostAddress = addresses.address
+	}
+	return &containerSD{
+		scrapers:    scrapers,
+		addressMode: c.String("sd.address"),
+		hostAddress: hostAddress,
+	}
 }
 
-//func getInterfaceIP(interfaceName string) string {
-//	inter, err := net.InterfaceByName(interfaceName)
-//	if err != nil {
-//		log.Error("Get network interface ", interfaceName, " error: ", err)
-//		return "127.0.0.1"
-//	}
-//	interAddresses, err := inter.Addrs()
-//	if err != nil {
-//		log.Error("Get network interface ", interfaceName, " address error", err)
-//		return "127.0.0.1"
-//	}
-//	for _, interAddr := range interAddresses {
-//		ip, _, err := net.ParseCIDR(interAddr.String())
-//		if err != nil {
-//			log.Warn("Parse CIDR error: ", err)
-//			continue
-//		}
-//		ipv4 := ip.To4()
-//		if ipv4 != nil {
-//			return ipv4.String()
-//		}
-//	}
-//	return "127.0.0.1"
-//}
+// newConsulConnector creates the Consul connector from the --consul-* flags.
+func newConsulConnector(c *cli.Context) *consulConnector {
+	connector := &consulConnector{
+		datacenter: c.String("consul-dc"),
+		token:      c.String("consul-token"),
+		tokenFile:  c.String("consul-token-file"),
+		tlsConfig: api.TLSConfig{
+			Address:            c.String("consul-tls-server-name"),
+			CAFile:             c.String("consul-tls-ca"),
+			CertFile:           c.String("consul-tls-cert"),
+			KeyFile:            c.String("consul-tls-key"),
+			InsecureSkipVerify: c.Bool("consul-tls-skip-verify"),
+		},
+		timeout: consulRequestTimeout,
+	}
+
+	// setting consul, a comma separated list of agents to fail over between
+	for _, address := range strings.Split(c.String("consul-address"), ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			connector.addresses = append(connector.addresses, address)
+		}
+	}
+	if len(connector.addresses) == 0 {
+		connector.addresses = []string{api.DefaultConfig().Address}
+	}
+
+	consulUsername := c.String("consul-username")
+	consulPassword := c.String("consul-password")
+	if consulUsername != "" && consulPassword != "" {
+		connector.httpAuth = &api.HttpBasicAuth{
+			Username: consulUsername,
+			Password: consulPassword,
+		}
+	}
+
+	return connector
+}
 
 // 生成随机 Service ID 后缀
 func consulServiceIDSuffix() string {
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysfsPath is the mount point of the host sys filesystem, used to resolve
+// host side veth names.
+var sysfsPath = "/sys"
+
+// netInterface is a network interface seen from inside a container.
+type netInterface struct {
+	name string
+	mac  string
+	// ifindex of the peer interface, the host veth for bridge networks
+	iflink int
+}
+
+// readContainerInterfaces lists the interfaces of the container network
+// namespace. Names come from /proc/<pid>/net/dev, link details from the sysfs
+// mounted in the container root.
+func readContainerInterfaces(pid int) ([]netInterface, error) {
+	procDir := filepath.Join(procfsPath, strconv.Itoa(pid))
+
+	file, err := os.Open(filepath.Join(procDir, "net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var interfaces []netInterface
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		colon := strings.Index(line, ":")
+		// header lines have no colon
+		if colon < 0 {
+			continue
+		}
+		name := strings.TrimSpace(line[:colon])
+		if name == "lo" {
+			continue
+		}
+
+		netDir := filepath.Join(procDir, "root", "sys", "class", "net", name)
+		iflink, err := readIntFile(filepath.Join(netDir, "iflink"))
+		if err != nil {
+			return nil, err
+		}
+		mac, err := readStringFile(filepath.Join(netDir, "address"))
+		if err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, netInterface{name: name, mac: mac, iflink: iflink})
+	}
+	return interfaces, scanner.Err()
+}
+
+// readHostInterfaces maps ifindex to interface name in the host network namespace.
+func readHostInterfaces() (map[int]string, error) {
+	netDir := filepath.Join(sysfsPath, "class", "net")
+	entries, err := ioutil.ReadDir(netDir)
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces := make(map[int]string, len(entries))
+	for _, entry := range entries {
+		ifindex, err := readIntFile(filepath.Join(netDir, entry.Name(), "ifindex"))
+		if err != nil {
+			// interface removed while reading
+			continue
+		}
+		interfaces[ifindex] = entry.Name()
+	}
+	return interfaces, nil
+}
+
+func readStringFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readIntFile(path string) (int, error) {
+	data, err := readStringFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(data)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig is the --web.config.file, in the format of the Prometheus
+// exporter toolkit.
+type webConfig struct {
+	TLSServerConfig *tlsServerConfig `yaml:"tls_server_config"`
+	// user name to bcrypt hash
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+}
+
+type tlsServerConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// NoClientCert, RequestClientCert, RequireAnyClientCert,
+	// VerifyClientCertIfGiven or RequireAndVerifyClientCert
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	// TLS10, TLS11, TLS12 or TLS13
+	MinVersion string `yaml:"min_version"`
+}
+
+var (
+	tlsClientAuthTypes = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+	tlsVersions = map[string]uint16{
+		"":      tls.VersionTLS12,
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+)
+
+// loadWebConfig reads and validates the web config, loading the certificates once.
+func loadWebConfig(path string) (*webConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := new(webConfig)
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("parse web config %s: %s", path, err)
+	}
+
+	for user, hash := range config.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("web config %s: user %s: %s", path, user, err)
+		}
+	}
+
+	if tlsConfig := config.TLSServerConfig; tlsConfig != nil {
+		if tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
+			return nil, fmt.Errorf("web config %s: cert_file and key_file are required", path)
+		}
+		clientAuth, ok := tlsClientAuthTypes[tlsConfig.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("web config %s: unknown client_auth_type %q", path, tlsConfig.ClientAuthType)
+		}
+		if tlsConfig.ClientCAFile == "" && (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) {
+			return nil, fmt.Errorf("web config %s: client_auth_type %s needs client_ca_file", path, tlsConfig.ClientAuthType)
+		}
+		if _, ok := tlsVersions[tlsConfig.MinVersion]; !ok {
+			return nil, fmt.Errorf("web config %s: unknown min_version %q", path, tlsConfig.MinVersion)
+		}
+		if _, err := tlsConfig.load(); err != nil {
+			return nil, fmt.Errorf("web config %s: %s", path, err)
+		}
+	}
+	return config, nil
+}
+
+// load builds the server TLS config from the certificate files.
+func (c *tlsServerConfig) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tlsClientAuthTypes[c.ClientAuthType],
+		MinVersion:   tlsVersions[c.MinVersion],
+	}
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in client_ca_file %s", c.ClientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+// tlsReloader reloads the certificates when one of their files changed, a
+// broken rotation keeps the last good certificates.
+type tlsReloader struct {
+	config *tlsServerConfig
+
+	mu       sync.Mutex
+	modTimes []time.Time
+	current  *tls.Config
+}
+
+func (c *webConfig) serverTLSConfig() *tls.Config {
+	reloader := &tlsReloader{config: c.TLSServerConfig}
+	return &tls.Config{
+		// ListenAndServeTLS needs a certificate source
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			config, err := reloader.get()
+			if err != nil {
+				return nil, err
+			}
+			return &config.Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return reloader.get()
+		},
+	}
+}
+
+func (r *tlsReloader) get() (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var modTimes []time.Time
+	for _, path := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCAFile} {
+		var modTime time.Time
+		if path != "" {
+			if info, err := os.Stat(path); err == nil {
+				modTime = info.ModTime()
+			}
+		}
+		modTimes = append(modTimes, modTime)
+	}
+	if r.current != nil && equalTimes(modTimes, r.modTimes) {
+		return r.current, nil
+	}
+
+	config, err := r.config.load()
+	if err != nil {
+		if r.current != nil {
+			log.WithField("file", r.config.CertFile).WithError(err).Error("Reload TLS certificate error, keep the last one")
+			r.modTimes = modTimes
+			return r.current, nil
+		}
+		return nil, err
+	}
+	if r.current != nil {
+		log.WithField("file", r.config.CertFile).Info("Reload TLS certificate")
+	}
+	r.current, r.modTimes = config, modTimes
+	return config, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// basicAuth requires one of the users on every path but the health checks,
+// which orchestrators and Consul poll without credentials. Verified
+// credentials are cached, bcrypt is slow on purpose.
+type basicAuth struct {
+	users map[string]string
+	next  http.Handler
+
+	// unknown users are compared to it, so they take as long as known ones
+	dummyHash []byte
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+func (c *webConfig) handler(next http.Handler) http.Handler {
+	if len(c.BasicAuthUsers) == 0 {
+		return next
+	}
+	dummyHash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	return &basicAuth{
+		users:     c.BasicAuthUsers,
+		next:      next,
+		dummyHash: dummyHash,
+		verified:  make(map[[sha256.Size]byte]bool),
+	}
+}
+
+func (a *basicAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path == "/health" || request.URL.Path == "/ready" {
+		a.next.ServeHTTP(writer, request)
+		return
+	}
+	user, password, ok := request.BasicAuth()
+	if ok && a.check(user, password) {
+		a.next.ServeHTTP(writer, request)
+		return
+	}
+	writer.Header().Set("WWW-Authenticate", `Basic realm="prometheus_docker_exporter"`)
+	http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func (a *basicAuth) check(user, password string) bool {
+	hash, ok := a.users[user]
+	key := sha256.Sum256([]byte(strings.Join([]string{user, password, hash}, "\x00")))
+	a.mu.Lock()
+	verified := a.verified[key]
+	a.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	a.verified[key] = true
+	a.mu.Unlock()
+	return true
+}